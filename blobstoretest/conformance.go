@@ -0,0 +1,482 @@
+// Package blobstoretest provides a conformance suite that every
+// blobstore.BlobStore implementation is expected to pass, so that the
+// behavior of the different backends doesn't drift apart.
+package blobstoretest
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hyperpilotio/blobstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory returns the store the conformance tests run against. The store
+// is expected to be empty, and the suite deletes every key it stores after
+// each test so the same store can be returned for every call.
+type Factory func(t *testing.T) blobstore.BlobStore
+
+type Deployment struct {
+	Name string
+	Type string
+	Spec string
+}
+
+// RunConformance runs the conformance suite against the stores returned by factory.
+func RunConformance(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, store blobstore.BlobStore, keys *[]string)
+	}{
+		{"StoreLoad", testStoreLoad},
+		{"Overwrite", testOverwrite},
+		{"Delete", testDelete},
+		{"LoadAll", testLoadAll},
+		{"LoadAllEmpty", testLoadAllEmpty},
+		{"MissingKey", testMissingKey},
+		{"InvalidKey", testInvalidKey},
+		{"LargeValue", testLargeValue},
+		{"SpecialCharacterKeys", testSpecialCharacterKeys},
+		{"CancelledContext", testCancelledContext},
+		{"ListKeys", testListKeys},
+		{"ListKeysPage", testListKeysPage},
+		{"ListKeysSpecialCharacters", testListKeysSpecialCharacters},
+		{"LoadPage", testLoadPage},
+		{"Iterate", testIterate},
+		{"Stat", testStat},
+		{"Batch", testBatch},
+		{"Versions", testVersions},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			store := factory(t)
+			keys := []string{}
+			defer cleanup(store, &keys)
+			test.test(t, store, &keys)
+		})
+	}
+}
+
+func cleanup(store blobstore.BlobStore, keys *[]string) {
+	for _, key := range *keys {
+		store.Delete(key)
+	}
+}
+
+func store(t *testing.T, s blobstore.BlobStore, keys *[]string, key string, deployment *Deployment) {
+	*keys = append(*keys, key)
+	require.Nil(t, s.Store(key, deployment), "Store %s error should be nil", key)
+}
+
+func testStoreLoad(t *testing.T, s blobstore.BlobStore, keys *[]string) {
+	deployment := &Deployment{Name: "redis", Type: "GCP", Spec: "replicas: 3"}
+	store(t, s, keys, "redis", deployment)
+
+	loaded := &Deployment{}
+	require.Nil(t, s.Load("redis", loaded), "Load error should be nil")
+	assert.Equal(t, deployment, loaded)
+}
+
+func testOverwrite(t *testing.T, s blobstore.BlobStore, keys *[]string) {
+	store(t, s, keys, "redis", &Deployment{Name: "redis", Type: "GCP", Spec: "replicas: 3, memory: 512Mi"})
+	store(t, s, keys, "redis", &Deployment{Name: "redis", Type: "AWS", Spec: "replicas: 1"})
+
+	loaded := &Deployment{}
+	require.Nil(t, s.Load("redis", loaded), "Load error should be nil")
+	assert.Equal(t, &Deployment{Name: "redis", Type: "AWS", Spec: "replicas: 1"}, loaded)
+}
+
+func testDelete(t *testing.T, s blobstore.BlobStore, keys *[]string) {
+	store(t, s, keys, "redis", &Deployment{Name: "redis"})
+	require.Nil(t, s.Delete("redis"), "Delete error should be nil")
+
+	err := s.Load("redis", &Deployment{})
+	assert.True(t, errors.Is(err, blobstore.ErrNotFound), "Load after delete should be ErrNotFound, got %v", err)
+}
+
+func testLoadAll(t *testing.T, s blobstore.BlobStore, keys *[]string) {
+	names := []string{"mysql", "redis", "spark"}
+	for _, name := range names {
+		store(t, s, keys, name, &Deployment{Name: name, Type: "GCP"})
+	}
+
+	items, err := s.LoadAll(func() interface{} {
+		return &Deployment{}
+	})
+	require.Nil(t, err, "LoadAll error should be nil")
+
+	loaded := []string{}
+	for _, item := range items.([]interface{}) {
+		loaded = append(loaded, item.(*Deployment).Name)
+	}
+	sort.Strings(loaded)
+	assert.Equal(t, names, loaded)
+}
+
+func testLoadAllEmpty(t *testing.T, s blobstore.BlobStore, keys *[]string) {
+	items, err := s.LoadAll(func() interface{} {
+		return &Deployment{}
+	})
+	require.Nil(t, err, "LoadAll error should be nil")
+	assert.Equal(t, 0, len(items.([]interface{})))
+}
+
+func testMissingKey(t *testing.T, s blobstore.BlobStore, keys *[]string) {
+	err := s.Load("missing", &Deployment{})
+	assert.True(t, errors.Is(err, blobstore.ErrNotFound), "Load should be ErrNotFound, got %v", err)
+
+	err = s.Delete("missing")
+	assert.True(t, errors.Is(err, blobstore.ErrNotFound), "Delete should be ErrNotFound, got %v", err)
+}
+
+func testInvalidKey(t *testing.T, s blobstore.BlobStore, keys *[]string) {
+	err := s.Store("", &Deployment{})
+	assert.True(t, errors.Is(err, blobstore.ErrInvalidKey), "Store should be ErrInvalidKey, got %v", err)
+
+	err = s.Load("", &Deployment{})
+	assert.True(t, errors.Is(err, blobstore.ErrInvalidKey), "Load should be ErrInvalidKey, got %v", err)
+
+	err = s.Load("redis", nil)
+	assert.True(t, errors.Is(err, blobstore.ErrInvalidObject), "Load should be ErrInvalidObject, got %v", err)
+}
+
+func testLargeValue(t *testing.T, s blobstore.BlobStore, keys *[]string) {
+	deployment := &Deployment{Name: "redis", Spec: strings.Repeat("0123456789", 1000)}
+	store(t, s, keys, "redis", deployment)
+
+	loaded := &Deployment{}
+	require.Nil(t, s.Load("redis", loaded), "Load error should be nil")
+	assert.Equal(t, deployment, loaded)
+}
+
+func testSpecialCharacterKeys(t *testing.T, s blobstore.BlobStore, keys *[]string) {
+	for _, key := range []string{
+		"with space", "with-dash.and_dot", "ключ", "部署", "a+b=c@d#e",
+		"it's", "') or itemName() like '%", "back`tick", "\"double\"", "50%", "emoji 🚀",
+	} {
+		deployment := &Deployment{Name: key}
+		store(t, s, keys, key, deployment)
+
+		loaded := &Deployment{}
+		if assert.Nil(t, s.Load(key, loaded), "Load %s error should be nil", key) {
+			assert.Equal(t, deployment, loaded)
+		}
+	}
+}
+
+func testCancelledContext(t *testing.T, s blobstore.BlobStore, keys *[]string) {
+	ctxStore, ok := s.(blobstore.ContextBlobStore)
+	if !ok {
+		t.Skip("Store doesn't implement ContextBlobStore")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	*keys = append(*keys, "redis")
+	assert.NotNil(t, ctxStore.StoreContext(ctx, "redis", &Deployment{Name: "redis"}), "Store with cancelled context should fail")
+	assert.NotNil(t, ctxStore.LoadContext(ctx, "redis", &Deployment{}), "Load with cancelled context should fail")
+	_, err := ctxStore.LoadAllContext(ctx, func() interface{} {
+		return &Deployment{}
+	})
+	assert.NotNil(t, err, "LoadAll with cancelled context should fail")
+
+	if lister, ok := s.(blobstore.ContextKeyLister); ok {
+		_, _, err := lister.ListKeysPageContext(ctx, "", "", 0)
+		assert.NotNil(t, err, "ListKeysPage with cancelled context should fail")
+	}
+
+	if loader, ok := s.(blobstore.ContextPageLoader); ok {
+		_, _, err := loader.LoadPageContext(ctx, func() interface{} {
+			return &Deployment{}
+		}, "", 0)
+		assert.NotNil(t, err, "LoadPage with cancelled context should fail")
+	}
+
+	if stater, ok := s.(blobstore.ContextStater); ok {
+		_, err := stater.StatContext(ctx, "redis")
+		assert.NotNil(t, err, "Stat with cancelled context should fail")
+	}
+
+	if batch, ok := s.(blobstore.ContextBatchStore); ok {
+		objects := []interface{}{&Deployment{Name: "redis"}}
+		assert.NotNil(t, batch.StoreMultiContext(ctx, []string{"redis"}, objects), "StoreMulti with cancelled context should fail")
+		assert.NotNil(t, batch.LoadMultiContext(ctx, []string{"redis"}, objects), "LoadMulti with cancelled context should fail")
+		assert.NotNil(t, batch.DeleteMultiContext(ctx, []string{"redis"}), "DeleteMulti with cancelled context should fail")
+	}
+
+	if versioned, ok := s.(blobstore.ContextVersionedStore); ok {
+		assert.NotNil(t, versioned.CreateContext(ctx, "redis", &Deployment{Name: "redis"}), "Create with cancelled context should fail")
+		assert.NotNil(t, versioned.StoreIfVersionContext(ctx, "redis", &Deployment{Name: "redis"}, "1"), "StoreIfVersion with cancelled context should fail")
+	}
+}
+
+func testListKeys(t *testing.T, s blobstore.BlobStore, keys *[]string) {
+	lister, ok := s.(blobstore.KeyLister)
+	if !ok {
+		t.Skip("Store doesn't implement KeyLister")
+	}
+
+	for _, key := range []string{"app-redis", "db-mysql", "app-spark"} {
+		store(t, s, keys, key, &Deployment{Name: key})
+	}
+
+	listed, err := lister.ListKeys("")
+	require.Nil(t, err, "ListKeys error should be nil")
+	assert.Equal(t, []string{"app-redis", "app-spark", "db-mysql"}, listed)
+
+	listed, err = lister.ListKeys("app-")
+	require.Nil(t, err, "ListKeys error should be nil")
+	assert.Equal(t, []string{"app-redis", "app-spark"}, listed)
+
+	listed, err = lister.ListKeys("none-")
+	require.Nil(t, err, "ListKeys error should be nil")
+	assert.Equal(t, 0, len(listed))
+}
+
+func testListKeysSpecialCharacters(t *testing.T, s blobstore.BlobStore, keys *[]string) {
+	lister, ok := s.(blobstore.KeyLister)
+	if !ok {
+		t.Skip("Store doesn't implement KeyLister")
+	}
+
+	for _, key := range []string{"50%-off", "50-more", "it's-quoted", "its-plain"} {
+		store(t, s, keys, key, &Deployment{Name: key})
+	}
+
+	listed, err := lister.ListKeys("50%")
+	require.Nil(t, err, "ListKeys error should be nil")
+	assert.Equal(t, []string{"50%-off"}, listed)
+
+	listed, err = lister.ListKeys("it's")
+	require.Nil(t, err, "ListKeys error should be nil")
+	assert.Equal(t, []string{"it's-quoted"}, listed)
+}
+
+func testListKeysPage(t *testing.T, s blobstore.BlobStore, keys *[]string) {
+	lister, ok := s.(blobstore.KeyLister)
+	if !ok {
+		t.Skip("Store doesn't implement KeyLister")
+	}
+
+	names := []string{"key-1", "key-2", "key-3", "key-4", "key-5"}
+	for _, name := range names {
+		store(t, s, keys, name, &Deployment{Name: name})
+	}
+
+	listed := []string{}
+	cursor := ""
+	for pages := 0; pages < len(names)+1; pages++ {
+		page, next, err := lister.ListKeysPage("key-", cursor, 2)
+		require.Nil(t, err, "ListKeysPage error should be nil")
+		assert.True(t, len(page) <= 2, "Page should have at most 2 keys")
+
+		listed = append(listed, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, names, listed)
+}
+
+func testLoadPage(t *testing.T, s blobstore.BlobStore, keys *[]string) {
+	loader, ok := s.(blobstore.PageLoader)
+	if !ok {
+		t.Skip("Store doesn't implement PageLoader")
+	}
+
+	names := []string{"key-1", "key-2", "key-3", "key-4", "key-5"}
+	for _, name := range names {
+		store(t, s, keys, name, &Deployment{Name: name})
+	}
+
+	loaded := []string{}
+	cursor := ""
+	for pages := 0; pages < len(names)+1; pages++ {
+		items, next, err := loader.LoadPage(func() interface{} {
+			return &Deployment{}
+		}, cursor, 2)
+		require.Nil(t, err, "LoadPage error should be nil")
+		assert.True(t, len(items.([]interface{})) <= 2, "Page should have at most 2 objects")
+
+		for _, item := range items.([]interface{}) {
+			loaded = append(loaded, item.(*Deployment).Name)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	sort.Strings(loaded)
+	assert.Equal(t, names, loaded)
+}
+
+func testIterate(t *testing.T, s blobstore.BlobStore, keys *[]string) {
+	iterable, ok := s.(blobstore.Iterable)
+	if !ok {
+		t.Skip("Store doesn't implement Iterable")
+	}
+
+	names := []string{"mysql", "redis", "spark"}
+	for _, name := range names {
+		store(t, s, keys, name, &Deployment{Name: name})
+	}
+
+	factory := func() interface{} {
+		return &Deployment{}
+	}
+
+	iterated := []string{}
+	err := iterable.Iterate(factory, func(key string, object interface{}) error {
+		assert.Equal(t, key, object.(*Deployment).Name)
+		iterated = append(iterated, key)
+		return nil
+	})
+	require.Nil(t, err, "Iterate error should be nil")
+	sort.Strings(iterated)
+	assert.Equal(t, names, iterated)
+
+	count := 0
+	err = iterable.Iterate(factory, func(key string, object interface{}) error {
+		count++
+		if count == 2 {
+			return blobstore.ErrStopIteration
+		}
+		return nil
+	})
+	require.Nil(t, err, "Stopped Iterate error should be nil")
+	assert.Equal(t, 2, count)
+
+	callbackErr := errors.New("callback error")
+	err = iterable.Iterate(factory, func(key string, object interface{}) error {
+		return callbackErr
+	})
+	assert.Equal(t, callbackErr, err)
+}
+
+func testStat(t *testing.T, s blobstore.BlobStore, keys *[]string) {
+	stater, ok := s.(blobstore.Stater)
+	if !ok {
+		t.Skip("Store doesn't implement Stater")
+	}
+
+	info, err := stater.Stat("redis")
+	require.Nil(t, err, "Stat error should be nil")
+	assert.False(t, info.Exists, "Missing key should not exist")
+
+	store(t, s, keys, "redis", &Deployment{Name: "redis", Type: "GCP"})
+	info, err = stater.Stat("redis")
+	require.Nil(t, err, "Stat error should be nil")
+	assert.True(t, info.Exists, "Stored key should exist")
+	assert.Equal(t, "redis", info.Key)
+	assert.True(t, info.Size > 0, "Stored key size should be positive")
+
+	require.Nil(t, s.Delete("redis"), "Delete error should be nil")
+	info, err = stater.Stat("redis")
+	require.Nil(t, err, "Stat error should be nil")
+	assert.False(t, info.Exists, "Deleted key should not exist")
+}
+
+func testBatch(t *testing.T, s blobstore.BlobStore, keys *[]string) {
+	batch, ok := s.(blobstore.BatchStore)
+	if !ok {
+		t.Skip("Store doesn't implement BatchStore")
+	}
+
+	names := []string{"mysql", "redis", "spark"}
+	*keys = append(*keys, names...)
+	err := batch.StoreMulti(names, []interface{}{
+		&Deployment{Name: "mysql"},
+		&Deployment{Name: "redis"},
+		&Deployment{Name: "spark"},
+	})
+	require.Nil(t, err, "StoreMulti error should be nil")
+
+	loaded := []interface{}{&Deployment{}, &Deployment{}, &Deployment{}, &Deployment{}}
+	err = batch.LoadMulti([]string{"spark", "missing", "mysql", "redis"}, loaded)
+	multiErr, ok := err.(blobstore.MultiError)
+	require.True(t, ok, "LoadMulti error should be a MultiError, got %v", err)
+	assert.Nil(t, multiErr[0])
+	assert.True(t, errors.Is(multiErr[1], blobstore.ErrNotFound), "Missing key should be ErrNotFound, got %v", multiErr[1])
+	assert.Nil(t, multiErr[2])
+	assert.Nil(t, multiErr[3])
+	assert.True(t, errors.Is(err, blobstore.ErrNotFound), "MultiError should match ErrNotFound")
+	assert.Equal(t, "spark", loaded[0].(*Deployment).Name)
+	assert.Equal(t, "mysql", loaded[2].(*Deployment).Name)
+	assert.Equal(t, "redis", loaded[3].(*Deployment).Name)
+
+	err = batch.DeleteMulti([]string{"mysql", "redis"})
+	require.Nil(t, err, "DeleteMulti error should be nil")
+
+	err = batch.LoadMulti([]string{"mysql", "spark"}, []interface{}{&Deployment{}, &Deployment{}})
+	multiErr, ok = err.(blobstore.MultiError)
+	require.True(t, ok, "LoadMulti error should be a MultiError, got %v", err)
+	assert.True(t, errors.Is(multiErr[0], blobstore.ErrNotFound), "Deleted key should be ErrNotFound, got %v", multiErr[0])
+	assert.Nil(t, multiErr[1])
+
+	err = batch.StoreMulti([]string{"redis"}, []interface{}{})
+	assert.NotNil(t, err, "StoreMulti with mismatched lengths should fail")
+
+	err = batch.StoreMulti([]string{"spark", "spark"}, []interface{}{
+		&Deployment{Name: "spark", Type: "first"},
+		&Deployment{Name: "spark", Type: "second"},
+	})
+	multiErr, ok = err.(blobstore.MultiError)
+	require.True(t, ok, "StoreMulti error should be a MultiError, got %v", err)
+	assert.Nil(t, multiErr[0])
+	assert.True(t, errors.Is(multiErr[1], blobstore.ErrInvalidKey), "Repeated key should be ErrInvalidKey, got %v", multiErr[1])
+
+	loadedSpark := &Deployment{}
+	require.Nil(t, s.Load("spark", loadedSpark), "Load error should be nil")
+	assert.Equal(t, "first", loadedSpark.Type, "First of the repeated keys should be stored")
+
+	err = batch.DeleteMulti([]string{"spark", "spark"})
+	multiErr, ok = err.(blobstore.MultiError)
+	require.True(t, ok, "DeleteMulti error should be a MultiError, got %v", err)
+	assert.Nil(t, multiErr[0])
+	assert.True(t, errors.Is(multiErr[1], blobstore.ErrInvalidKey), "Repeated key should be ErrInvalidKey, got %v", multiErr[1])
+}
+
+func testVersions(t *testing.T, s blobstore.BlobStore, keys *[]string) {
+	versioned, ok := s.(blobstore.VersionedStore)
+	if !ok {
+		t.Skip("Store doesn't implement VersionedStore")
+	}
+
+	*keys = append(*keys, "redis")
+	require.Nil(t, versioned.Create("redis", &Deployment{Name: "redis", Type: "GCP"}), "Create error should be nil")
+
+	err := versioned.Create("redis", &Deployment{Name: "redis", Type: "AWS"})
+	assert.True(t, errors.Is(err, blobstore.ErrConflict), "Create of existing key should be ErrConflict, got %v", err)
+
+	info, err := versioned.Stat("redis")
+	require.Nil(t, err, "Stat error should be nil")
+	created := info.Version
+
+	err = versioned.StoreIfVersion("redis", &Deployment{Name: "redis", Type: "AWS"}, created)
+	require.Nil(t, err, "StoreIfVersion with current version error should be nil")
+
+	info, err = versioned.Stat("redis")
+	require.Nil(t, err, "Stat error should be nil")
+	assert.NotEqual(t, created, info.Version, "Version should change after store")
+
+	err = versioned.StoreIfVersion("redis", &Deployment{Name: "redis", Type: "Azure"}, created)
+	assert.True(t, errors.Is(err, blobstore.ErrConflict), "StoreIfVersion with old version should be ErrConflict, got %v", err)
+
+	loaded := &Deployment{}
+	require.Nil(t, s.Load("redis", loaded), "Load error should be nil")
+	assert.Equal(t, "AWS", loaded.Type)
+
+	err = versioned.StoreIfVersion("missing", &Deployment{Name: "missing"}, created)
+	assert.True(t, errors.Is(err, blobstore.ErrNotFound), "StoreIfVersion of missing key should be ErrNotFound, got %v", err)
+
+	require.Nil(t, s.Delete("redis"), "Delete error should be nil")
+	require.Nil(t, versioned.Create("redis", &Deployment{Name: "redis"}), "Create after delete error should be nil")
+}
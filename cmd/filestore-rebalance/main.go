@@ -0,0 +1,46 @@
+// Command filestore-rebalance moves the files of a file store to the
+// layout of the given shard depth, after changing store.shardDepth.
+// Processes using the store are blocked until it's done.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/hyperpilotio/blobstore"
+)
+
+// config passes the flags as the file store settings
+type config map[string]string
+
+func (c config) GetString(name string) string {
+	return c[name]
+}
+
+func main() {
+	filesPath := flag.String("filesPath", "", "Folder holding the file stores")
+	name := flag.String("name", "", "Name of the file store")
+	shardDepth := flag.Int("shardDepth", 0, "Shard depth to move the files to, 0 for a flat folder")
+	flag.Parse()
+
+	if *filesPath == "" || *name == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	store, err := blobstore.NewFile(*name, config{
+		"filesPath":        *filesPath,
+		"store.shardDepth": strconv.Itoa(*shardDepth),
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to open file store: "+err.Error())
+		os.Exit(1)
+	}
+
+	if err := store.Rebalance(); err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to rebalance file store: "+err.Error())
+		os.Exit(1)
+	}
+}
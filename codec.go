@@ -0,0 +1,234 @@
+package blobstore
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"strings"
+
+	"github.com/ugorji/go/codec"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec encodes objects to bytes for stores, and decodes them back.
+type Codec interface {
+	Marshal(object interface{}) ([]byte, error)
+	Unmarshal(data []byte, object interface{}) error
+	// ContentType is the MIME type of the encoded data.
+	ContentType() string
+}
+
+// codecs are the codecs selectable with the store.codec setting.
+var codecs = map[string]Codec{
+	"json":    JSONCodec{},
+	"gob":     GobCodec{},
+	"msgpack": MsgpackCodec{},
+	"cbor":    CBORCodec{},
+	// Only encode proto messages, which every store encodes with a
+	// protobuf codec whatever its codec, see messageCodec
+	"protobuf":  ProtoCodec{},
+	"protojson": ProtoCodec{JSON: true},
+}
+
+// NewCodec returns the codec named by the store.codec setting, which is
+// JSON if it's not set.
+func NewCodec(config BlobStoreConfig) (Codec, error) {
+	name := strings.ToLower(config.GetString("store.codec"))
+	if name == "" {
+		return JSONCodec{}, nil
+	}
+
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported codec: %s", name)
+	}
+
+	return codec, nil
+}
+
+// newBlobCodec returns the codec of attribute stores, which store objects as
+// a single encoded blob instead of attributes if store.blob is set or values
+// are compressed, or nil if objects are stored as attributes.
+func newBlobCodec(config BlobStoreConfig) (Codec, error) {
+	compression, err := NewCompression(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if !getConfigBool(config, "store.blob") && compression == nil {
+		return nil, nil
+	}
+
+	return NewCodec(config)
+}
+
+// messageCodec returns the codec of the object, which is the store codec
+// except for proto messages, whose internal fields are mangled by the
+// reflection based codecs and mappers. Messages are encoded as canonical
+// protojson by JSON stores, and as binary protobuf otherwise, including
+// by attribute stores that are not in blob mode. The envelopes of the
+// EncryptedStore are marked, see envelopeCodec.
+func messageCodec(codec Codec, object interface{}) Codec {
+	if _, ok := object.(*encryptedObject); ok && codec != nil {
+		return envelopeCodec{Codec: codec}
+	}
+
+	if _, ok := object.(proto.Message); !ok {
+		return codec
+	}
+
+	switch codec.(type) {
+	case ProtoCodec:
+		return codec
+	case JSONCodec:
+		return ProtoCodec{JSON: true}
+	}
+
+	return ProtoCodec{}
+}
+
+// codecByContentType returns the codec of data stored with the content
+// type, so stores can read data stored with another codec.
+func codecByContentType(contentType string) (Codec, error) {
+	for _, codec := range codecs {
+		if codec.ContentType() == contentType {
+			return codec, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Unsupported content type: %s", contentType)
+}
+
+// JSONCodec encodes objects as JSON, naming fields by their blobstore tag
+// or their json tag.
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(object interface{}) ([]byte, error) {
+	return marshalJSON(object)
+}
+
+func (JSONCodec) Unmarshal(data []byte, object interface{}) error {
+	return unmarshalJSON(data, object)
+}
+
+func (JSONCodec) ContentType() string {
+	return "application/json"
+}
+
+// GobCodec encodes objects with encoding/gob, which names fields by their
+// Go names and ignores tags.
+type GobCodec struct{}
+
+func (GobCodec) Marshal(object interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(object); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, object interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(object)
+}
+
+func (GobCodec) ContentType() string {
+	return "application/x-gob"
+}
+
+// Struct tags read by the MessagePack and CBOR codecs, which support the
+// name, omitempty and "-" options.
+var codecTypeInfos = codec.NewTypeInfos([]string{"blobstore", "json"})
+
+var (
+	msgpackHandle = &codec.MsgpackHandle{WriteExt: true}
+	cborHandle    = &codec.CborHandle{}
+)
+
+func init() {
+	// Decodes MessagePack strings to string instead of []byte in interfaces
+	msgpackHandle.RawToString = true
+	msgpackHandle.TypeInfos = codecTypeInfos
+	cborHandle.TypeInfos = codecTypeInfos
+}
+
+// MsgpackCodec encodes objects as MessagePack, naming fields by their
+// blobstore tag or their json tag.
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Marshal(object interface{}) ([]byte, error) {
+	return encodeWithHandle(object, msgpackHandle)
+}
+
+func (MsgpackCodec) Unmarshal(data []byte, object interface{}) error {
+	return codec.NewDecoderBytes(data, msgpackHandle).Decode(object)
+}
+
+func (MsgpackCodec) ContentType() string {
+	return "application/msgpack"
+}
+
+// CBORCodec encodes objects as CBOR, naming fields by their blobstore tag
+// or their json tag.
+type CBORCodec struct{}
+
+func (CBORCodec) Marshal(object interface{}) ([]byte, error) {
+	return encodeWithHandle(object, cborHandle)
+}
+
+func (CBORCodec) Unmarshal(data []byte, object interface{}) error {
+	return codec.NewDecoderBytes(data, cborHandle).Decode(object)
+}
+
+func (CBORCodec) ContentType() string {
+	return "application/cbor"
+}
+
+func encodeWithHandle(object interface{}, handle codec.Handle) ([]byte, error) {
+	var b []byte
+	if err := codec.NewEncoderBytes(&b, handle).Encode(object); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// ProtoCodec encodes proto messages as binary protobuf, or as canonical
+// protojson with JSON.
+type ProtoCodec struct {
+	JSON bool
+}
+
+func (c ProtoCodec) Marshal(object interface{}) ([]byte, error) {
+	message, ok := object.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a proto message", object)
+	}
+
+	if c.JSON {
+		return protojson.Marshal(message)
+	}
+
+	return proto.Marshal(message)
+}
+
+func (c ProtoCodec) Unmarshal(data []byte, object interface{}) error {
+	message, ok := object.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not a proto message", object)
+	}
+
+	if c.JSON {
+		return protojson.Unmarshal(data, message)
+	}
+
+	return proto.Unmarshal(data, message)
+}
+
+func (c ProtoCodec) ContentType() string {
+	if c.JSON {
+		return "application/x-protobuf+json"
+	}
+	return "application/x-protobuf"
+}
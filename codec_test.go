@@ -0,0 +1,172 @@
+package blobstore
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/simpledb"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	datastore "google.golang.org/api/datastore/v1"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	for name, codec := range codecs {
+		if _, ok := codec.(ProtoCodec); ok {
+			// Only encode proto messages, see TestProtoCodec
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			fields := newTaggedFields()
+			b, err := codec.Marshal(fields)
+			assert.Nil(t, err)
+
+			loaded := &taggedFields{}
+			assert.Nil(t, codec.Unmarshal(b, loaded))
+			if name != "gob" {
+				// Gob ignores tags
+				fields.Skipped = ""
+			}
+			assert.Equal(t, fields, loaded)
+
+			found, err := codecByContentType(codec.ContentType())
+			assert.Nil(t, err)
+			assert.Equal(t, codec, found)
+		})
+	}
+}
+
+func TestCodecTags(t *testing.T) {
+	fields := newTaggedFields()
+	fields.Skipped = "skipped"
+	for _, codec := range []Codec{MsgpackCodec{}, CBORCodec{}} {
+		b, err := codec.Marshal(fields)
+		assert.Nil(t, err)
+
+		decoded := map[string]interface{}{}
+		assert.Nil(t, codec.Unmarshal(b, &decoded))
+		assert.Equal(t, "redis", decoded["name"], codec.ContentType())
+		assert.Equal(t, "json", decoded["json_name"], codec.ContentType())
+		assert.Contains(t, decoded, "renamed", codec.ContentType())
+		assert.NotContains(t, decoded, "Skipped", codec.ContentType())
+		assert.NotContains(t, decoded, "omitted", codec.ContentType())
+	}
+}
+
+func TestNewCodec(t *testing.T) {
+	config := viper.New()
+	codec, err := NewCodec(config)
+	assert.Nil(t, err)
+	assert.Equal(t, JSONCodec{}, codec)
+
+	config.Set("store.codec", "MsgPack")
+	codec, err = NewCodec(config)
+	assert.Nil(t, err)
+	assert.Equal(t, MsgpackCodec{}, codec)
+
+	config.Set("store.codec", "xml")
+	_, err = NewCodec(config)
+	assert.NotNil(t, err)
+
+	config.Set("store.codec", "cbor")
+	codec, err = newBlobCodec(config)
+	assert.Nil(t, err)
+	assert.Nil(t, codec, "Attribute stores should only use codecs in blob mode")
+
+	config.Set("store.blob", "true")
+	codec, err = newBlobCodec(config)
+	assert.Nil(t, err)
+	assert.Equal(t, CBORCodec{}, codec)
+}
+
+func TestStoresWithCodec(t *testing.T) {
+	file, err := NewFileStore("testStore")
+	if err != nil {
+		panic(err)
+	}
+	file.Codec = MsgpackCodec{}
+
+	memory, err := NewMemory("testStore", nil)
+	if err != nil {
+		panic(err)
+	}
+	memory.Codec = GobCodec{}
+
+	for _, store := range []BlobStore{file, memory} {
+		fields := newTaggedFields()
+		assert.Nil(t, store.Store("encoded", fields), "Store error should be nil")
+
+		loaded := &taggedFields{}
+		assert.Nil(t, store.Load("encoded", loaded), "Load error should be nil")
+		assert.Equal(t, fields.Spec, loaded.Spec)
+		assert.Equal(t, fields.Notes, loaded.Notes)
+	}
+}
+
+func TestSimpleDBBlobAttributes(t *testing.T) {
+	db := &SimpleDB{Codec: CBORCodec{}}
+	fields := newTaggedFields()
+	fields.Notes = strings.Repeat("long note ", 500)
+	replaceable, err := db.versionedAttributes(fields)
+	assert.Nil(t, err)
+
+	attributes := map[string]string{}
+	for _, attribute := range replaceable {
+		attributes[*attribute.Name] = *attribute.Value
+	}
+	assert.NotContains(t, attributes, "name", "Fields should not be stored as attributes")
+	assert.True(t, strings.HasSuffix(attributes[simpledbBlobAttribute], " application/cbor"))
+	for name, value := range attributes {
+		assert.True(t, len(value) <= simpledbMaxValueLen, name)
+	}
+
+	// Parts of a longer blob stored before are ignored
+	attributes[simpledbBlobAttribute+"_99"] = "stale"
+	loaded := &taggedFields{}
+	assert.Nil(t, db.setValue(loaded, simpledbItemAttributes(attributes)))
+	assert.Equal(t, fields, loaded)
+
+	// Items stored as attributes are still readable in blob mode, and
+	// attribute mode clears the blob of items stored in blob mode
+	replaceable, err = (&SimpleDB{}).versionedAttributes(fields)
+	assert.Nil(t, err)
+	for _, attribute := range replaceable {
+		attributes[*attribute.Name] = *attribute.Value
+	}
+	assert.Equal(t, "", attributes[simpledbBlobAttribute])
+	loaded = &taggedFields{}
+	assert.Nil(t, db.setValue(loaded, simpledbItemAttributes(attributes)))
+	assert.Equal(t, fields, loaded)
+}
+
+func simpledbItemAttributes(attributes map[string]string) []*simpledb.Attribute {
+	item := []*simpledb.Attribute{}
+	for name, value := range attributes {
+		item = append(item, &simpledb.Attribute{
+			Name:  aws.String(name),
+			Value: aws.String(value),
+		})
+	}
+	return item
+}
+
+func TestDatastoreBlobProperties(t *testing.T) {
+	db := &DatastoreDB{Codec: MsgpackCodec{}}
+	fields := newTaggedFields()
+	entity, err := db.entity("encoded", fields)
+	assert.Nil(t, err)
+	assert.Len(t, entity.Properties, 2)
+	assert.True(t, entity.Properties[datastoreBlobProperty].ExcludeFromIndexes)
+
+	// Values read back from the API as JSON
+	b, err := json.Marshal(entity.Properties)
+	assert.Nil(t, err)
+	props := map[string]datastore.Value{}
+	assert.Nil(t, json.Unmarshal(b, &props))
+
+	loaded := &taggedFields{}
+	assert.Nil(t, setEntityValue(loaded, props, nil))
+	assert.Equal(t, fields, loaded)
+}
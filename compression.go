@@ -0,0 +1,284 @@
+package blobstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// Prefix of compressed values, followed by the compression name and a
+	// newline. Encoded objects can't start with it: it isn't valid JSON,
+	// CBOR, a MessagePack map or a gob message length, and it isn't a
+	// canonical protobuf tag.
+	compressionMagic = "\xff\x00"
+	// Compression names can not be greater than 16 bytes
+	compressionMaxNameLen = 16
+	// Size limit of decompressed values when store.maxDecompressedSize is
+	// not set
+	defaultMaxDecompressedSize = 64 << 20
+)
+
+// Compression compresses encoded values before stores write them.
+type Compression interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+	// Name identifies the compression in the header of compressed values.
+	Name() string
+}
+
+// compressions are the compressions selectable with the store.compression
+// setting.
+var compressions = map[string]Compression{
+	"gzip":   GzipCompression{},
+	"zstd":   ZstdCompression{},
+	"snappy": SnappyCompression{},
+}
+
+// NewCompression returns the compression named by the store.compression
+// setting, or nil if values are not compressed. The store.maxDecompressedSize
+// setting limits the size of the values it decompresses.
+func NewCompression(config BlobStoreConfig) (Compression, error) {
+	name := strings.ToLower(config.GetString("store.compression"))
+	if name == "" || name == "none" {
+		return nil, nil
+	}
+
+	compression, ok := compressions[name]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported compression: %s", name)
+	}
+
+	maxSize, err := getConfigInt(config, "store.maxDecompressedSize")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse max decompressed size: %s", err.Error())
+	}
+
+	switch compression.(type) {
+	case GzipCompression:
+		compression = GzipCompression{MaxSize: maxSize}
+	case ZstdCompression:
+		compression = ZstdCompression{MaxSize: maxSize}
+	case SnappyCompression:
+		compression = SnappyCompression{MaxSize: maxSize}
+	}
+
+	return compression, nil
+}
+
+// maxDecompressedSize returns the size limit, or the default one if it's
+// not set.
+func maxDecompressedSize(maxSize int) int {
+	if maxSize <= 0 {
+		return defaultMaxDecompressedSize
+	}
+	return maxSize
+}
+
+// errDecompressedSize is returned for values larger than the size limit
+// once decompressed, which may be crafted to exhaust memory.
+func errDecompressedSize(maxSize int) error {
+	return fmt.Errorf("Decompressed value is larger than %d bytes", maxSize)
+}
+
+// encodeObject encodes the object with its codec, see messageCodec, and
+// compresses it with a header naming the compression if it's not nil.
+func encodeObject(codec Codec, compression Compression, object interface{}) ([]byte, error) {
+	codec = messageCodec(codec, object)
+	b, err := codec.Marshal(object)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to marshall object to %s: %s", codec.ContentType(), err.Error())
+	}
+
+	if compression == nil {
+		return b, nil
+	}
+
+	compressed, err := compression.Compress(b)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to compress object with %s: %s", compression.Name(), err.Error())
+	}
+
+	header := compressionMagic + compression.Name() + "\n"
+	return append([]byte(header), compressed...), nil
+}
+
+// decodeObject decodes data returned by encodeObject into the object, so
+// compressed and uncompressed values can be read whatever the compression
+// of the store. Values compressed like the store's are decompressed with
+// its compression and size limit, others with the default limit.
+func decodeObject(codec Codec, compression Compression, data []byte, object interface{}) error {
+	data, err := decompress(compression, data)
+	if err != nil {
+		return err
+	}
+
+	return messageCodec(codec, object).Unmarshal(data, object)
+}
+
+func decompress(compression Compression, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(compressionMagic)) {
+		return data, nil
+	}
+
+	header := data[len(compressionMagic):]
+	if len(header) > compressionMaxNameLen+1 {
+		header = header[:compressionMaxNameLen+1]
+	}
+	end := bytes.IndexByte(header, '\n')
+	if end < 0 {
+		return nil, fmt.Errorf("Unable to find compression header end")
+	}
+
+	name := string(header[:end])
+	decompressor, ok := compressions[name]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported compression: %s", name)
+	}
+	if compression != nil && compression.Name() == name {
+		decompressor = compression
+	}
+
+	b, err := decompressor.Decompress(data[len(compressionMagic)+end+1:])
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decompress %s value: %s", name, err.Error())
+	}
+
+	return b, nil
+}
+
+type GzipCompression struct {
+	// MaxSize limits the size of decompressed values, 64MB if not set
+	MaxSize int
+}
+
+func (GzipCompression) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (compression GzipCompression) Decompress(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	maxSize := maxDecompressedSize(compression.MaxSize)
+	b, err := ioutil.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxSize {
+		return nil, errDecompressedSize(maxSize)
+	}
+
+	return b, nil
+}
+
+func (GzipCompression) Name() string {
+	return "gzip"
+}
+
+// The zstd encoder and decoders can be used concurrently, and are only
+// created when zstd is used. Decoders are kept by their size limit.
+var (
+	zstdOnce     sync.Once
+	zstdEncoder  *zstd.Encoder
+	zstdErr      error
+	zstdDecoders sync.Map
+)
+
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+	})
+
+	return zstdErr
+}
+
+// zstdDecoder returns the decoder of values up to maxSize bytes.
+func zstdDecoder(maxSize int) (*zstd.Decoder, error) {
+	if decoder, ok := zstdDecoders.Load(maxSize); ok {
+		return decoder.(*zstd.Decoder), nil
+	}
+
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(maxSize)))
+	if err != nil {
+		return nil, err
+	}
+
+	if stored, loaded := zstdDecoders.LoadOrStore(maxSize, decoder); loaded {
+		decoder.Close()
+		return stored.(*zstd.Decoder), nil
+	}
+
+	return decoder, nil
+}
+
+type ZstdCompression struct {
+	// MaxSize limits the size of decompressed values, 64MB if not set
+	MaxSize int
+}
+
+func (ZstdCompression) Compress(data []byte) ([]byte, error) {
+	if err := initZstd(); err != nil {
+		return nil, err
+	}
+
+	return zstdEncoder.EncodeAll(data, nil), nil
+}
+
+func (compression ZstdCompression) Decompress(data []byte) ([]byte, error) {
+	decoder, err := zstdDecoder(maxDecompressedSize(compression.MaxSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return decoder.DecodeAll(data, nil)
+}
+
+func (ZstdCompression) Name() string {
+	return "zstd"
+}
+
+type SnappyCompression struct {
+	// MaxSize limits the size of decompressed values, 64MB if not set
+	MaxSize int
+}
+
+func (SnappyCompression) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (compression SnappyCompression) Decompress(data []byte) ([]byte, error) {
+	// Snappy values start with their decoded length
+	size, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize := maxDecompressedSize(compression.MaxSize); size > maxSize {
+		return nil, errDecompressedSize(maxSize)
+	}
+
+	return snappy.Decode(nil, data)
+}
+
+func (SnappyCompression) Name() string {
+	return "snappy"
+}
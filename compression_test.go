@@ -0,0 +1,154 @@
+package blobstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	datastore "google.golang.org/api/datastore/v1"
+)
+
+func newCompressibleFields() *taggedFields {
+	fields := newTaggedFields()
+	fields.Notes = strings.Repeat("redis master with 2 replicas\n", 200)
+	return fields
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	fields := newCompressibleFields()
+	plain, err := encodeObject(JSONCodec{}, nil, fields)
+	assert.Nil(t, err)
+
+	for name, compression := range compressions {
+		b, err := encodeObject(JSONCodec{}, compression, fields)
+		assert.Nil(t, err, name)
+		assert.True(t, bytes.HasPrefix(b, []byte(compressionMagic+name+"\n")), name)
+		assert.True(t, len(b) < len(plain)/4, name)
+
+		loaded := &taggedFields{}
+		assert.Nil(t, decodeObject(JSONCodec{}, nil, b, loaded), name)
+		assert.Equal(t, fields, loaded, name)
+	}
+
+	// Values stored without compression are still readable
+	loaded := &taggedFields{}
+	assert.Nil(t, decodeObject(JSONCodec{}, nil, plain, loaded))
+	assert.Equal(t, fields, loaded)
+
+	assert.NotNil(t, decodeObject(JSONCodec{}, nil, []byte(compressionMagic+"lzma\n{}"), loaded))
+	assert.NotNil(t, decodeObject(JSONCodec{}, nil, []byte(compressionMagic+"gzip\nnot gzip"), loaded))
+}
+
+func TestDecompressedSizeLimit(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 1<<20)
+	for name, compression := range compressions {
+		b, err := compression.Compress(data)
+		assert.Nil(t, err, name)
+
+		_, err = compression.Decompress(b)
+		assert.Nil(t, err, name)
+
+		config := viper.New()
+		config.Set("store.compression", name)
+		config.Set("store.maxDecompressedSize", "1024")
+		limited, err := NewCompression(config)
+		assert.Nil(t, err, name)
+		_, err = limited.Decompress(b)
+		assert.NotNil(t, err, "%s value over the limit should fail", name)
+
+		// The limit of the store applies to values read by their header
+		encoded := append([]byte(compressionMagic+name+"\n"), b...)
+		_, err = decompress(limited, encoded)
+		assert.NotNil(t, err, "%s value over the limit should fail", name)
+	}
+}
+
+func TestNewCompression(t *testing.T) {
+	config := viper.New()
+	compression, err := NewCompression(config)
+	assert.Nil(t, err)
+	assert.Nil(t, compression)
+
+	config.Set("store.compression", "Zstd")
+	compression, err = NewCompression(config)
+	assert.Nil(t, err)
+	assert.Equal(t, ZstdCompression{}, compression)
+
+	// Compressed values are stored as blobs by attribute stores
+	codec, err := newBlobCodec(config)
+	assert.Nil(t, err)
+	assert.Equal(t, JSONCodec{}, codec)
+
+	config.Set("store.compression", "lz4")
+	_, err = NewCompression(config)
+	assert.NotNil(t, err)
+}
+
+func TestFileStoreCompression(t *testing.T) {
+	store, err := NewFileStore("testStore")
+	if err != nil {
+		panic(err)
+	}
+
+	fields := newCompressibleFields()
+	assert.Nil(t, store.Store("plain", fields), "Store error should be nil")
+
+	store.Compression = GzipCompression{}
+	assert.Nil(t, store.Store("compressed", fields), "Store error should be nil")
+	b, err := ioutil.ReadFile(path.Join(store.Path, "compressed"))
+	assert.Nil(t, err)
+	assert.True(t, bytes.HasPrefix(b, []byte(compressionMagic+"gzip\n")))
+
+	// Compressed and uncompressed files coexist whatever the compression
+	for _, compression := range []Compression{nil, GzipCompression{}, SnappyCompression{}} {
+		store.Compression = compression
+		items, err := store.LoadAll(func() interface{} { return &taggedFields{} })
+		assert.Nil(t, err, "LoadAll error should be nil")
+		assert.Equal(t, []interface{}{fields, fields}, items)
+	}
+}
+
+func TestSimpleDBCompressedBlob(t *testing.T) {
+	fields := newCompressibleFields()
+	db := &SimpleDB{Codec: JSONCodec{}}
+	replaceable, err := db.versionedAttributes(fields)
+	assert.Nil(t, err)
+	assert.True(t, len(replaceable) > 5)
+
+	db.Compression = ZstdCompression{}
+	replaceable, err = db.versionedAttributes(fields)
+	assert.Nil(t, err)
+
+	attributes := map[string]string{}
+	for _, attribute := range replaceable {
+		attributes[*attribute.Name] = *attribute.Value
+	}
+	assert.Equal(t, "1 application/json", attributes[simpledbBlobAttribute])
+
+	loaded := &taggedFields{}
+	assert.Nil(t, (&SimpleDB{}).setValue(loaded, simpledbItemAttributes(attributes)))
+	assert.Equal(t, fields, loaded)
+}
+
+func TestDatastoreCompressedBlob(t *testing.T) {
+	fields := newCompressibleFields()
+	db := &DatastoreDB{Codec: CBORCodec{}, Compression: SnappyCompression{}}
+	entity, err := db.entity("compressed", fields)
+	assert.Nil(t, err)
+
+	// Values read back from the API as JSON
+	b, err := json.Marshal(entity.Properties)
+	assert.Nil(t, err)
+	props := map[string]datastore.Value{}
+	assert.Nil(t, json.Unmarshal(b, &props))
+	assert.True(t, len(props[datastoreBlobProperty].BlobValue) < len(fields.Notes)/4)
+
+	loaded := &taggedFields{}
+	assert.Nil(t, setEntityValue(loaded, props, nil))
+	assert.Equal(t, fields, loaded)
+}
@@ -0,0 +1,122 @@
+package blobstore_test
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/hyperpilotio/blobstore"
+	"github.com/hyperpilotio/blobstore/blobstoretest"
+	"github.com/spf13/viper"
+)
+
+// The cloud backends only run against real services when their
+// credentials are set in the environment.
+const (
+	awsIdEnv              = "BLOBSTORE_TEST_AWS_ID"
+	awsSecretEnv          = "BLOBSTORE_TEST_AWS_SECRET"
+	awsRegionEnv          = "BLOBSTORE_TEST_AWS_REGION"
+	gcpServiceAccountEnv  = "BLOBSTORE_TEST_GCP_SERVICE_ACCOUNT"
+	conformanceStoreName  = "blobstoreConformance"
+	conformanceDomainName = "Test"
+)
+
+func TestFileStoreConformance(t *testing.T) {
+	blobstoretest.RunConformance(t, func(t *testing.T) blobstore.BlobStore {
+		config := viper.New()
+		config.Set("filesPath", t.TempDir())
+		store, err := blobstore.NewFile(conformanceStoreName, config)
+		if err != nil {
+			t.Fatalf("Unable to create file store: %s", err.Error())
+		}
+		return store
+	})
+}
+
+func TestShardedFileStoreConformance(t *testing.T) {
+	blobstoretest.RunConformance(t, func(t *testing.T) blobstore.BlobStore {
+		config := viper.New()
+		config.Set("filesPath", t.TempDir())
+		config.Set("store.shardDepth", 2)
+		store, err := blobstore.NewFile(conformanceStoreName, config)
+		if err != nil {
+			t.Fatalf("Unable to create file store: %s", err.Error())
+		}
+		return store
+	})
+}
+
+func TestMemoryStoreConformance(t *testing.T) {
+	blobstoretest.RunConformance(t, func(t *testing.T) blobstore.BlobStore {
+		store, err := blobstore.NewMemory(conformanceStoreName, viper.New())
+		if err != nil {
+			t.Fatalf("Unable to create memory store: %s", err.Error())
+		}
+		return store
+	})
+}
+
+func TestEncryptedStoreConformance(t *testing.T) {
+	blobstoretest.RunConformance(t, func(t *testing.T) blobstore.BlobStore {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatalf("Unable to generate key: %s", err.Error())
+		}
+		keyPath := path.Join(t.TempDir(), "keys.json")
+		keyFile := fmt.Sprintf(`{"currentKeyId": "test", "keys": {"test": "%s"}}`, base64.StdEncoding.EncodeToString(key))
+		if err := ioutil.WriteFile(keyPath, []byte(keyFile), 0600); err != nil {
+			t.Fatalf("Unable to write key file: %s", err.Error())
+		}
+
+		config := viper.New()
+		config.Set("store.type", "memory")
+		config.Set("store.encryptionKeyFile", keyPath)
+		store, err := blobstore.NewBlobStore(conformanceStoreName, config)
+		if err != nil {
+			t.Fatalf("Unable to create encrypted store: %s", err.Error())
+		}
+		return store
+	})
+}
+
+func TestSimpleDBConformance(t *testing.T) {
+	if os.Getenv(awsIdEnv) == "" || os.Getenv(awsSecretEnv) == "" {
+		t.Skipf("%s and %s are not set", awsIdEnv, awsSecretEnv)
+	}
+
+	config := viper.New()
+	config.Set("awsId", os.Getenv(awsIdEnv))
+	config.Set("awsSecret", os.Getenv(awsSecretEnv))
+	config.Set("store.region", os.Getenv(awsRegionEnv))
+	config.Set("store.domainPostfix", conformanceDomainName)
+	store, err := blobstore.NewSimpleDB(conformanceStoreName, config)
+	if err != nil {
+		t.Fatalf("Unable to create simpledb store: %s", err.Error())
+	}
+
+	blobstoretest.RunConformance(t, func(t *testing.T) blobstore.BlobStore {
+		return store
+	})
+}
+
+func TestDatastoreConformance(t *testing.T) {
+	if os.Getenv(gcpServiceAccountEnv) == "" {
+		t.Skipf("%s is not set", gcpServiceAccountEnv)
+	}
+
+	config := viper.New()
+	config.Set("gcpServiceAccountJSONFile", os.Getenv(gcpServiceAccountEnv))
+	config.Set("store.domainPostfix", conformanceDomainName)
+	store, err := blobstore.NewDatastoreDB(conformanceStoreName, config)
+	if err != nil {
+		t.Fatalf("Unable to create datastore store: %s", err.Error())
+	}
+
+	blobstoretest.RunConformance(t, func(t *testing.T) blobstore.BlobStore {
+		return store
+	})
+}
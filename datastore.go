@@ -1,25 +1,49 @@
 package blobstore
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"net/http"
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/golang/glog"
 	"github.com/spf13/viper"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	datastore "google.golang.org/api/datastore/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// GCP datastore commits can not have more than 500 mutations
+	datastoreMaxMutations = 500
+	// GCP datastore lookups can not have more than 1000 keys
+	datastoreMaxLookupKeys = 1000
+	// Properties holding the encoded object and its content type in blob mode
+	// and for proto messages
+	datastoreBlobProperty        = "@blob"
+	datastoreContentTypeProperty = "@contentType"
 )
 
 type DatastoreDB struct {
-	Name         string
-	DomainName   string
-	ProjectId    string
-	Config       BlobStoreConfig
+	Name       string
+	DomainName string
+	ProjectId  string
+	Config     BlobStoreConfig
+	// Codec encodes objects to a single blob property when set, instead of
+	// storing their fields as properties. Blobs are compressed with
+	// Compression.
+	Codec        Codec
+	Compression  Compression
 	datastoreSvc *datastore.Service
 }
 
@@ -27,13 +51,23 @@ func NewDatastoreDB(name string, config BlobStoreConfig) (*DatastoreDB, error) {
 	serviceAccountPath := config.GetString("gcpServiceAccountJSONFile")
 	datastoreSvc, err := createDatastoreService(serviceAccountPath)
 	if err != nil {
-		return nil, errors.New("Unable to create GCP datastore service: " + err.Error())
+		return nil, fmt.Errorf("Unable to create GCP datastore service: %w", err)
 	}
 
 	domainName := getDomainName(name, config)
 	projectId, err := getProjectId(serviceAccountPath)
 	if err != nil {
-		return nil, errors.New("Unable to get project id from service account file: " + err.Error())
+		return nil, fmt.Errorf("Unable to get project id from service account file: %w", err)
+	}
+
+	codec, err := newBlobCodec(config)
+	if err != nil {
+		return nil, err
+	}
+
+	compression, err := NewCompression(config)
+	if err != nil {
+		return nil, err
 	}
 
 	return &DatastoreDB{
@@ -41,132 +75,666 @@ func NewDatastoreDB(name string, config BlobStoreConfig) (*DatastoreDB, error) {
 		DomainName:   domainName,
 		ProjectId:    projectId,
 		Config:       config,
+		Codec:        codec,
+		Compression:  compression,
 		datastoreSvc: datastoreSvc,
 	}, nil
 }
 
 func (db *DatastoreDB) Store(key string, object interface{}) error {
-	properties := map[string]datastore.Value{}
-	if err := recursiveEntityProperties(properties, object); err != nil {
-		return errors.New("Unable to set properties to entity: " + err.Error())
+	return db.StoreContext(context.Background(), key, object)
+}
+
+func (db *DatastoreDB) StoreContext(ctx context.Context, key string, object interface{}) error {
+	if err := validateDatastoreKey(key); err != nil {
+		return err
 	}
-	entity := &datastore.Entity{
-		Key: &datastore.Key{
-			PartitionId: &datastore.PartitionId{
-				ProjectId: db.ProjectId,
-			},
-			Path: []*datastore.PathElement{
-				&datastore.PathElement{
-					Kind: db.DomainName,
-					Name: key,
-				},
-			},
-		},
-		Properties: properties,
+
+	entity, err := db.entity(key, object)
+	if err != nil {
+		return err
 	}
 
-	gql := fmt.Sprintf("SELECT * FROM %s WHERE __key__ = KEY(%s, '%s')",
-		db.DomainName, db.DomainName, key)
-	resp, err := db.datastoreSvc.Projects.
-		RunQuery(db.ProjectId, &datastore.RunQueryRequest{
-			PartitionId: &datastore.PartitionId{
-				ProjectId: db.ProjectId,
-			},
-			GqlQuery: &datastore.GqlQuery{
-				AllowLiterals: true,
-				QueryString:   gql,
+	_, err = db.datastoreSvc.Projects.
+		Commit(db.ProjectId, &datastore.CommitRequest{
+			Mode: "NON_TRANSACTIONAL",
+			Mutations: []*datastore.Mutation{
+				&datastore.Mutation{Upsert: entity},
 			},
-		}).Do()
+		}).Context(ctx).Do()
 	if err != nil {
-		return errors.New("Unable to select data from GCP datastore: " + err.Error())
+		return fmt.Errorf("Unable to commit request to GCP datastore: %w", err)
 	}
 
-	var mutation datastore.Mutation
-	if len(resp.Batch.EntityResults) == 0 {
-		mutation = datastore.Mutation{Insert: entity}
-	} else {
-		mutation = datastore.Mutation{Update: entity}
+	return nil
+}
+
+func (db *DatastoreDB) Create(key string, object interface{}) error {
+	return db.CreateContext(context.Background(), key, object)
+}
+
+func (db *DatastoreDB) CreateContext(ctx context.Context, key string, object interface{}) error {
+	if err := validateDatastoreKey(key); err != nil {
+		return err
+	}
+
+	entity, err := db.entity(key, object)
+	if err != nil {
+		return err
 	}
 
 	_, err = db.datastoreSvc.Projects.
 		Commit(db.ProjectId, &datastore.CommitRequest{
-			Mode:      "NON_TRANSACTIONAL",
-			Mutations: []*datastore.Mutation{&mutation},
-		}).Do()
+			Mode: "NON_TRANSACTIONAL",
+			Mutations: []*datastore.Mutation{
+				&datastore.Mutation{Insert: entity},
+			},
+		}).Context(ctx).Do()
 	if err != nil {
-		return errors.New("Unable to commit request to GCP datastore: " + err.Error())
+		if isDatastoreConflict(err) {
+			return fmt.Errorf("Unable to create %s, entity already exists: %w", key, ErrConflict)
+		}
+		return fmt.Errorf("Unable to commit request to GCP datastore: %w", err)
 	}
 
 	return nil
 }
 
-func (db *DatastoreDB) Load(key string, object interface{}) error {
-	gql := fmt.Sprintf("SELECT * FROM %s WHERE __key__ = KEY(%s, '%s')",
-		db.DomainName, db.DomainName, key)
-	resp, err := db.datastoreSvc.Projects.
-		RunQuery(db.ProjectId, &datastore.RunQueryRequest{
-			PartitionId: &datastore.PartitionId{
-				ProjectId: db.ProjectId,
+func (db *DatastoreDB) StoreIfVersion(key string, object interface{}, expectedVersion string) error {
+	return db.StoreIfVersionContext(context.Background(), key, object, expectedVersion)
+}
+
+func (db *DatastoreDB) StoreIfVersionContext(ctx context.Context, key string, object interface{}, expectedVersion string) error {
+	if err := validateDatastoreKey(key); err != nil {
+		return err
+	}
+
+	entity, err := db.entity(key, object)
+	if err != nil {
+		return err
+	}
+
+	txResp, err := db.datastoreSvc.Projects.
+		BeginTransaction(db.ProjectId, &datastore.BeginTransactionRequest{}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("Unable to begin GCP datastore transaction: %w", err)
+	}
+
+	lookupResp, err := db.datastoreSvc.Projects.
+		Lookup(db.ProjectId, &datastore.LookupRequest{
+			Keys: []*datastore.Key{entity.Key},
+			ReadOptions: &datastore.ReadOptions{
+				Transaction: txResp.Transaction,
 			},
-			GqlQuery: &datastore.GqlQuery{
-				AllowLiterals: true,
-				QueryString:   gql,
+		}).Context(ctx).Do()
+	if err != nil {
+		db.rollback(txResp.Transaction)
+		return fmt.Errorf("Unable to lookup entity from GCP datastore: %w", err)
+	}
+
+	if len(lookupResp.Found) == 0 {
+		db.rollback(txResp.Transaction)
+		return fmt.Errorf("Unable to find %s entity from GCP datastore: %w", key, ErrNotFound)
+	}
+
+	version := lookupResp.Found[0].Version
+	if strconv.FormatInt(version, 10) != expectedVersion {
+		db.rollback(txResp.Transaction)
+		return fmt.Errorf("Unable to store %s, version %d is not %s: %w", key, version, expectedVersion, ErrConflict)
+	}
+
+	commitResp, err := db.datastoreSvc.Projects.
+		Commit(db.ProjectId, &datastore.CommitRequest{
+			Mode:        "TRANSACTIONAL",
+			Transaction: txResp.Transaction,
+			Mutations: []*datastore.Mutation{
+				&datastore.Mutation{
+					Update:      entity,
+					BaseVersion: version,
+				},
 			},
-		}).Do()
+		}).Context(ctx).Do()
 	if err != nil {
-		return errors.New("Unable to select data from GCP datastore: " + err.Error())
+		if isDatastoreConflict(err) {
+			return fmt.Errorf("Unable to store %s, transaction conflicted: %w", key, ErrConflict)
+		}
+		return fmt.Errorf("Unable to commit request to GCP datastore: %w", err)
+	}
+
+	if len(commitResp.MutationResults) > 0 && commitResp.MutationResults[0].ConflictDetected {
+		return fmt.Errorf("Unable to store %s, version changed: %w", key, ErrConflict)
 	}
-	recursiveSetEntityValue(object, resp.Batch.EntityResults[0].Entity.Properties)
 
 	return nil
 }
 
+func (db *DatastoreDB) Load(key string, object interface{}) error {
+	return db.LoadContext(context.Background(), key, object)
+}
+
+func (db *DatastoreDB) LoadContext(ctx context.Context, key string, object interface{}) error {
+	if err := validateDatastoreKey(key); err != nil {
+		return err
+	}
+
+	if err := validateObject(object); err != nil {
+		return err
+	}
+
+	resp, err := db.datastoreSvc.Projects.
+		Lookup(db.ProjectId, &datastore.LookupRequest{
+			Keys: []*datastore.Key{db.entityKey(key)},
+		}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("Unable to lookup entity from GCP datastore: %w", err)
+	}
+
+	if len(resp.Found) == 0 {
+		return fmt.Errorf("Unable to find %s entity from GCP datastore: %w", key, ErrNotFound)
+	}
+	return setEntityValue(object, resp.Found[0].Entity.Properties, db.Compression)
+}
+
 func (db *DatastoreDB) LoadAll(f func() interface{}) (interface{}, error) {
+	return db.LoadAllContext(context.Background(), f)
+}
+
+func (db *DatastoreDB) LoadAllContext(ctx context.Context, f func() interface{}) (interface{}, error) {
+	items := []interface{}{}
+	cursor := ""
+	for {
+		_, page, next, err := db.loadPage(ctx, f, cursor, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, page...)
+		if next == "" {
+			return items, nil
+		}
+		cursor = next
+	}
+}
+
+func (db *DatastoreDB) LoadPage(f func() interface{}, cursor string, limit int) (interface{}, string, error) {
+	return db.LoadPageContext(context.Background(), f, cursor, limit)
+}
+
+func (db *DatastoreDB) LoadPageContext(ctx context.Context, f func() interface{}, cursor string, limit int) (interface{}, string, error) {
+	_, items, next, err := db.loadPage(ctx, f, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return items, next, nil
+}
+
+func (db *DatastoreDB) Iterate(f func() interface{}, fn func(key string, object interface{}) error) error {
+	return iteratePages(context.Background(), db.loadPage, f, fn)
+}
+
+// loadPage queries up to limit entities starting from the cursor, which is
+// the end cursor of the previous query, and returns their keys and objects.
+func (db *DatastoreDB) loadPage(ctx context.Context, f func() interface{}, cursor string, limit int) ([]string, []interface{}, string, error) {
 	resp, err := db.datastoreSvc.Projects.
 		RunQuery(db.ProjectId, &datastore.RunQueryRequest{
 			PartitionId: &datastore.PartitionId{
 				ProjectId: db.ProjectId,
 			},
-			GqlQuery: &datastore.GqlQuery{
-				QueryString: "select * from " + db.DomainName,
+			Query: &datastore.Query{
+				Kind: []*datastore.KindExpression{
+					&datastore.KindExpression{Name: db.DomainName},
+				},
+				StartCursor: cursor,
+				Limit:       int64(limit),
 			},
-		}).Do()
+		}).Context(ctx).Do()
 	if err != nil {
-		return nil, errors.New("Unable to select data from GCP datastore: " + err.Error())
+		return nil, nil, "", fmt.Errorf("Unable to select data from GCP datastore: %w", err)
 	}
 
+	keys := []string{}
 	items := []interface{}{}
 	for _, entityResult := range resp.Batch.EntityResults {
 		v := f()
-		recursiveSetEntityValue(v, entityResult.Entity.Properties)
+		if err := setEntityValue(v, entityResult.Entity.Properties, db.Compression); err != nil {
+			return nil, nil, "", err
+		}
+
+		path := entityResult.Entity.Key.Path
+		keys = append(keys, path[len(path)-1].Name)
 		items = append(items, v)
 	}
 
-	return items, nil
+	return keys, items, nextCursor(resp.Batch), nil
 }
 
 func (db *DatastoreDB) Delete(key string) error {
-	_, err := db.datastoreSvc.Projects.
+	return db.DeleteContext(context.Background(), key)
+}
+
+func (db *DatastoreDB) DeleteContext(ctx context.Context, key string) error {
+	if err := validateDatastoreKey(key); err != nil {
+		return err
+	}
+
+	// Datastore deletes missing entities silently, so look the entity up
+	// first to report missing keys. Deleting without a transaction saves
+	// two requests, at the cost of not reporting a key deleted concurrently
+	// between the lookup and the commit.
+	lookupResp, err := db.datastoreSvc.Projects.
+		Lookup(db.ProjectId, &datastore.LookupRequest{
+			Keys: []*datastore.Key{db.entityKey(key)},
+		}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("Unable to lookup entity from GCP datastore: %w", err)
+	}
+
+	if len(lookupResp.Found) == 0 {
+		return fmt.Errorf("Unable to find %s entity from GCP datastore: %w", key, ErrNotFound)
+	}
+
+	_, err = db.datastoreSvc.Projects.
 		Commit(db.ProjectId, &datastore.CommitRequest{
 			Mode: "NON_TRANSACTIONAL",
 			Mutations: []*datastore.Mutation{
 				&datastore.Mutation{
-					Delete: &datastore.Key{
-						PartitionId: &datastore.PartitionId{
-							ProjectId: db.ProjectId,
-						},
-						Path: []*datastore.PathElement{
-							&datastore.PathElement{
-								Kind: db.DomainName,
-								Name: key,
-							},
-						},
-					},
+					Delete: db.entityKey(key),
 				},
 			},
-		}).Do()
+		}).Context(ctx).Do()
 	if err != nil {
-		return errors.New("Unable to delete entity from GCP datastore: " + err.Error())
+		return fmt.Errorf("Unable to delete entity from GCP datastore: %w", err)
+	}
+
+	return nil
+}
+
+func (db *DatastoreDB) Stat(key string) (*ObjectInfo, error) {
+	return db.StatContext(context.Background(), key)
+}
+
+func (db *DatastoreDB) StatContext(ctx context.Context, key string) (*ObjectInfo, error) {
+	if err := validateDatastoreKey(key); err != nil {
+		return nil, err
+	}
+
+	resp, err := db.datastoreSvc.Projects.
+		Lookup(db.ProjectId, &datastore.LookupRequest{
+			Keys: []*datastore.Key{db.entityKey(key)},
+		}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to lookup entity from GCP datastore: %w", err)
+	}
+
+	if len(resp.Found) == 0 {
+		return &ObjectInfo{Key: key}, nil
+	}
+
+	size := 0
+	for _, value := range resp.Found[0].Entity.Properties {
+		size += len(value.StringValue)
+	}
+
+	return &ObjectInfo{
+		Key:        key,
+		Exists:     true,
+		Size:       int64(size),
+		Version:    strconv.FormatInt(resp.Found[0].Version, 10),
+		Attributes: len(resp.Found[0].Entity.Properties),
+	}, nil
+}
+
+func (db *DatastoreDB) ListKeys(prefix string) ([]string, error) {
+	keys := []string{}
+	cursor := ""
+	for {
+		page, next, err := db.ListKeysPage(prefix, cursor, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, page...)
+		if next == "" {
+			return keys, nil
+		}
+		cursor = next
+	}
+}
+
+func (db *DatastoreDB) ListKeysPage(prefix string, cursor string, limit int) ([]string, string, error) {
+	return db.ListKeysPageContext(context.Background(), prefix, cursor, limit)
+}
+
+func (db *DatastoreDB) ListKeysPageContext(ctx context.Context, prefix string, cursor string, limit int) ([]string, string, error) {
+	query := &datastore.Query{
+		Kind: []*datastore.KindExpression{
+			&datastore.KindExpression{Name: db.DomainName},
+		},
+		Projection: []*datastore.Projection{
+			&datastore.Projection{
+				Property: &datastore.PropertyReference{Name: "__key__"},
+			},
+		},
+		Order: []*datastore.PropertyOrder{
+			&datastore.PropertyOrder{
+				Property:  &datastore.PropertyReference{Name: "__key__"},
+				Direction: "ASCENDING",
+			},
+		},
+		StartCursor: cursor,
+		Limit:       int64(limit),
+	}
+
+	if prefix != "" {
+		// Key names sort by their utf-8 bytes, so every name with the prefix
+		// is between the prefix and the prefix followed by the largest rune.
+		query.Filter = &datastore.Filter{
+			CompositeFilter: &datastore.CompositeFilter{
+				Op: "AND",
+				Filters: []*datastore.Filter{
+					db.keyFilter("GREATER_THAN_OR_EQUAL", prefix),
+					db.keyFilter("LESS_THAN", prefix+string(utf8.MaxRune)),
+				},
+			},
+		}
+	}
+
+	resp, err := db.datastoreSvc.Projects.
+		RunQuery(db.ProjectId, &datastore.RunQueryRequest{
+			PartitionId: &datastore.PartitionId{
+				ProjectId: db.ProjectId,
+			},
+			Query: query,
+		}).Context(ctx).Do()
+	if err != nil {
+		return nil, "", fmt.Errorf("Unable to query keys from GCP datastore: %w", err)
+	}
+
+	keys := []string{}
+	for _, entityResult := range resp.Batch.EntityResults {
+		path := entityResult.Entity.Key.Path
+		keys = append(keys, path[len(path)-1].Name)
+	}
+
+	return keys, nextCursor(resp.Batch), nil
+}
+
+// nextCursor returns the cursor to continue the query from, or an empty
+// cursor when the query has no more results.
+func nextCursor(batch *datastore.QueryResultBatch) string {
+	if batch.MoreResults == "NO_MORE_RESULTS" {
+		return ""
+	}
+
+	return batch.EndCursor
+}
+
+func (db *DatastoreDB) keyFilter(op string, key string) *datastore.Filter {
+	return &datastore.Filter{
+		PropertyFilter: &datastore.PropertyFilter{
+			Property: &datastore.PropertyReference{Name: "__key__"},
+			Op:       op,
+			Value: &datastore.Value{
+				KeyValue: db.entityKey(key),
+			},
+		},
+	}
+}
+
+func (db *DatastoreDB) StoreMulti(keys []string, objects []interface{}) error {
+	return db.StoreMultiContext(context.Background(), keys, objects)
+}
+
+func (db *DatastoreDB) StoreMultiContext(ctx context.Context, keys []string, objects []interface{}) error {
+	if err := validateMulti(keys, objects); err != nil {
+		return err
+	}
+
+	errs := make([]error, len(keys))
+	validDatastoreIndexes(keys, errs)
+	indexes := uniqueIndexes(keys, errs)
+	for _, chunk := range chunkIndexes(indexes, datastoreMaxMutations) {
+		mutations := []*datastore.Mutation{}
+		stored := []int{}
+		for _, i := range chunk {
+			entity, err := db.entity(keys[i], objects[i])
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+
+			mutations = append(mutations, &datastore.Mutation{Upsert: entity})
+			stored = append(stored, i)
+		}
+
+		if len(mutations) == 0 {
+			continue
+		}
+
+		_, err := db.datastoreSvc.Projects.
+			Commit(db.ProjectId, &datastore.CommitRequest{
+				Mode:      "NON_TRANSACTIONAL",
+				Mutations: mutations,
+			}).Context(ctx).Do()
+		if err != nil {
+			for _, i := range stored {
+				errs[i] = fmt.Errorf("Unable to commit request to GCP datastore: %w", err)
+			}
+		}
+	}
+
+	return multiError(errs)
+}
+
+func (db *DatastoreDB) LoadMulti(keys []string, objects []interface{}) error {
+	return db.LoadMultiContext(context.Background(), keys, objects)
+}
+
+func (db *DatastoreDB) LoadMultiContext(ctx context.Context, keys []string, objects []interface{}) error {
+	if err := validateMulti(keys, objects); err != nil {
+		return err
+	}
+
+	errs := make([]error, len(keys))
+	indexes := validDatastoreIndexes(keys, errs)
+	for _, chunk := range chunkIndexes(indexes, datastoreMaxLookupKeys) {
+		entities, err := db.lookupEntities(ctx, keys, chunk)
+		if err != nil {
+			for _, i := range chunk {
+				errs[i] = err
+			}
+			continue
+		}
+
+		for _, i := range chunk {
+			entity, ok := entities[keys[i]]
+			if !ok {
+				errs[i] = fmt.Errorf("Unable to find %s entity from GCP datastore: %w", keys[i], ErrNotFound)
+				continue
+			}
+
+			if err := validateObject(objects[i]); err != nil {
+				errs[i] = err
+				continue
+			}
+			errs[i] = setEntityValue(objects[i], entity.Properties, db.Compression)
+		}
+	}
+
+	return multiError(errs)
+}
+
+func (db *DatastoreDB) DeleteMulti(keys []string) error {
+	return db.DeleteMultiContext(context.Background(), keys)
+}
+
+func (db *DatastoreDB) DeleteMultiContext(ctx context.Context, keys []string) error {
+	errs := make([]error, len(keys))
+	validDatastoreIndexes(keys, errs)
+	indexes := uniqueIndexes(keys, errs)
+	for _, chunk := range chunkIndexes(indexes, datastoreMaxMutations) {
+		if err := db.deleteChunk(ctx, keys, chunk, errs); err != nil {
+			for _, i := range chunk {
+				if errs[i] == nil {
+					errs[i] = err
+				}
+			}
+		}
+	}
+
+	return multiError(errs)
+}
+
+// deleteChunk deletes the entities of the keys at the indexes, setting
+// ErrNotFound in errs for the keys that don't exist, like DeleteContext.
+func (db *DatastoreDB) deleteChunk(ctx context.Context, keys []string, indexes []int, errs []error) error {
+	entities, err := db.lookupEntities(ctx, keys, indexes)
+	if err != nil {
+		return err
+	}
+
+	mutations := []*datastore.Mutation{}
+	for _, i := range indexes {
+		if _, ok := entities[keys[i]]; !ok {
+			errs[i] = fmt.Errorf("Unable to find %s entity from GCP datastore: %w", keys[i], ErrNotFound)
+			continue
+		}
+
+		mutations = append(mutations, &datastore.Mutation{
+			Delete: db.entityKey(keys[i]),
+		})
+	}
+
+	if len(mutations) == 0 {
+		return nil
+	}
+
+	_, err = db.datastoreSvc.Projects.
+		Commit(db.ProjectId, &datastore.CommitRequest{
+			Mode:      "NON_TRANSACTIONAL",
+			Mutations: mutations,
+		}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("Unable to delete entities from GCP datastore: %w", err)
+	}
+
+	return nil
+}
+
+// lookupEntities looks up the entities of the keys at the indexes, and
+// returns the found entities by key name.
+func (db *DatastoreDB) lookupEntities(ctx context.Context, keys []string, indexes []int) (map[string]*datastore.Entity, error) {
+	lookupKeys := []*datastore.Key{}
+	for _, i := range indexes {
+		lookupKeys = append(lookupKeys, db.entityKey(keys[i]))
+	}
+
+	entities := map[string]*datastore.Entity{}
+	for len(lookupKeys) > 0 {
+		resp, err := db.datastoreSvc.Projects.
+			Lookup(db.ProjectId, &datastore.LookupRequest{
+				Keys: lookupKeys,
+			}).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to lookup entities from GCP datastore: %w", err)
+		}
+
+		for _, entityResult := range resp.Found {
+			path := entityResult.Entity.Key.Path
+			entities[path[len(path)-1].Name] = entityResult.Entity
+		}
+
+		// Keys that were not processed are deferred to another lookup
+		lookupKeys = resp.Deferred
+	}
+
+	return entities, nil
+}
+
+// validDatastoreIndexes returns the indexes of the valid keys, and sets the
+// error of the invalid ones in errs.
+func validDatastoreIndexes(keys []string, errs []error) []int {
+	indexes := []int{}
+	for i, key := range keys {
+		if err := validateDatastoreKey(key); err != nil {
+			errs[i] = err
+			continue
+		}
+		indexes = append(indexes, i)
+	}
+
+	return indexes
+}
+
+// rollback rolls back the transaction, without the context of the caller
+// which may be cancelled already, so the transaction isn't left open.
+func (db *DatastoreDB) rollback(transaction string) {
+	_, err := db.datastoreSvc.Projects.
+		Rollback(db.ProjectId, &datastore.RollbackRequest{
+			Transaction: transaction,
+		}).Context(context.Background()).Do()
+	if err != nil {
+		glog.Warningf("Unable to rollback GCP datastore transaction: %s", err.Error())
+	}
+}
+
+func (db *DatastoreDB) entity(key string, object interface{}) (*datastore.Entity, error) {
+	properties := map[string]datastore.Value{}
+	if codec := messageCodec(db.Codec, object); codec != nil {
+		b, err := encodeObject(codec, db.Compression, object)
+		if err != nil {
+			return nil, err
+		}
+		properties[datastoreBlobProperty] = datastore.Value{
+			BlobValue:          base64.StdEncoding.EncodeToString(b),
+			ExcludeFromIndexes: true,
+			ForceSendFields:    []string{"BlobValue"},
+		}
+		properties[datastoreContentTypeProperty] = datastore.Value{
+			StringValue:        codec.ContentType(),
+			ExcludeFromIndexes: true,
+		}
+	} else if err := recursiveEntityProperties(properties, object); err != nil {
+		return nil, fmt.Errorf("Unable to set properties to entity: %w", err)
+	}
+
+	return &datastore.Entity{
+		Key:        db.entityKey(key),
+		Properties: properties,
+	}, nil
+}
+
+// isDatastoreConflict returns whether the request failed because the entity
+// already exists or the transaction conflicted with another one.
+func isDatastoreConflict(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict
+}
+
+func (db *DatastoreDB) entityKey(key string) *datastore.Key {
+	return &datastore.Key{
+		PartitionId: &datastore.PartitionId{
+			ProjectId: db.ProjectId,
+		},
+		Path: []*datastore.PathElement{
+			&datastore.PathElement{
+				Kind: db.DomainName,
+				Name: key,
+			},
+		},
+	}
+}
+
+// validateDatastoreKey checks the key is a valid datastore key name,
+// which can't be greater than 1500 bytes or match __.*__
+func validateDatastoreKey(key string) error {
+	if err := validateKey(key, 1500); err != nil {
+		return err
+	}
+
+	if len(key) >= 4 && strings.HasPrefix(key, "__") && strings.HasSuffix(key, "__") {
+		return fmt.Errorf("Key %s is reserved by GCP datastore: %w", key, ErrInvalidKey)
 	}
 
 	return nil
@@ -175,18 +743,18 @@ func (db *DatastoreDB) Delete(key string) error {
 func createDatastoreService(serviceAccountPath string) (*datastore.Service, error) {
 	dat, err := ioutil.ReadFile(serviceAccountPath)
 	if err != nil {
-		return nil, errors.New("Unable to read service account file: " + err.Error())
+		return nil, fmt.Errorf("Unable to read service account file: %w", err)
 	}
 
 	conf, err := google.JWTConfigFromJSON(dat, datastore.DatastoreScope)
 	if err != nil {
-		return nil, errors.New("Unable to acquire generate config: " + err.Error())
+		return nil, fmt.Errorf("Unable to acquire generate config: %w", err)
 	}
 
 	client := conf.Client(oauth2.NoContext)
 	datastoreSvc, err := datastore.New(client)
 	if err != nil {
-		return nil, errors.New("Unable to create google cloud platform datastore service: " + err.Error())
+		return nil, fmt.Errorf("Unable to create google cloud platform datastore service: %w", err)
 	}
 
 	return datastoreSvc, nil
@@ -197,101 +765,218 @@ func recursiveEntityProperties(props map[string]datastore.Value, v interface{})
 		return errors.New("Empty interface")
 	}
 
-	modelReflect := reflect.ValueOf(v).Elem()
-	modelRefType := modelReflect.Type()
-	fieldsCount := modelReflect.NumField()
-
-	for i := 0; i < fieldsCount; i++ {
-		field := modelReflect.Field(i)
-		fieldName := modelRefType.Field(i).Name
-		fieldValue := fmt.Sprintf("%v", field.Interface())
-
-		switch field.Kind() {
-		case reflect.Interface, reflect.Ptr:
-			recursiveEntityProperties(props, field.Interface())
-		default:
-			if fieldValue != "" {
-				// datastore string value can not be greater than 1500
-				splitLen := 1500
-				if len(fieldValue) > splitLen {
-					valLen := 0
-					if len(fieldValue)%splitLen == 0 {
-						valLen = len(fieldValue) / splitLen
-					} else {
-						valLen = len(fieldValue)/splitLen + 1
-					}
-
-					for i := 0; i < valLen; i++ {
-						lastLndex := (i + 1) * splitLen
-						if lastLndex > len(fieldValue) {
-							lastLndex = len(fieldValue)
-						}
-						props[fmt.Sprintf("%s_%s", fieldName, strconv.Itoa(i+1))] = datastore.Value{
-							StringValue: fieldValue[i*splitLen : lastLndex],
-						}
-					}
-				} else {
-					props[fieldName] = datastore.Value{
-						StringValue: fieldValue,
-					}
-				}
-			} else {
-				props[fieldName] = datastore.Value{
-					NullValue: "NULL_VALUE",
-				}
-			}
+	return flattenFields(v, func(path string, field reflect.Value, noIndex bool) error {
+		if !field.IsValid() {
+			return nil
 		}
+
+		if isTextValue(field) {
+			setStringProperties(props, path, formatValue(field), noIndex)
+			return nil
+		}
+
+		value := entityValue(field)
+		value.ExcludeFromIndexes = value.ExcludeFromIndexes || noIndex
+		props[path] = value
+		return nil
+	})
+}
+
+// isTextValue returns whether the field is stored as a string value, which
+// are the strings and the types without a datastore value type.
+func isTextValue(field reflect.Value) bool {
+	for field.Kind() == reflect.Ptr && !field.IsNil() {
+		field = field.Elem()
 	}
 
-	return nil
+	switch field.Kind() {
+	case reflect.String, reflect.Complex64, reflect.Complex128:
+		return true
+	case reflect.Uint, reflect.Uint64, reflect.Uintptr:
+		// Values above the largest datastore integer are kept as text
+		return field.Uint() > math.MaxInt64
+	}
+	return !isValueType(field.Type())
 }
 
-func recursiveSetEntityValue(v interface{}, props map[string]datastore.Value) {
-	if v == nil || reflect.ValueOf(v).IsNil() {
+// setStringProperties sets the text as a string value, split into numbered
+// properties if it's too long for a single indexed one.
+func setStringProperties(props map[string]datastore.Value, fieldName string, fieldValue string, noIndex bool) {
+	if fieldValue == "" {
+		props[fieldName] = datastore.Value{
+			NullValue:          "NULL_VALUE",
+			ExcludeFromIndexes: noIndex,
+		}
 		return
 	}
 
-	modelReflect := reflect.ValueOf(v).Elem()
-	modelRefType := modelReflect.Type()
-	fieldsCount := modelReflect.NumField()
-
-	for i := 0; i < fieldsCount; i++ {
-		field := modelReflect.Field(i)
-		fieldName := modelRefType.Field(i).Name
+	// datastore indexed string value can not be greater than 1500
+	splitLen := 1500
+	if len(fieldValue) > splitLen && !noIndex {
+		valLen := 0
+		if len(fieldValue)%splitLen == 0 {
+			valLen = len(fieldValue) / splitLen
+		} else {
+			valLen = len(fieldValue)/splitLen + 1
+		}
 
-		switch field.Kind() {
-		case reflect.Interface, reflect.Ptr:
-			recursiveSetEntityValue(field.Interface(), props)
-		default:
-			attrValue := restorePropertiesValue(fieldName, props)
-			field.Set(reflect.ValueOf(attrValue))
+		for i := 0; i < valLen; i++ {
+			lastLndex := (i + 1) * splitLen
+			if lastLndex > len(fieldValue) {
+				lastLndex = len(fieldValue)
+			}
+			props[fmt.Sprintf("%s_%s", fieldName, strconv.Itoa(i+1))] = datastore.Value{
+				StringValue: fieldValue[i*splitLen : lastLndex],
+			}
 		}
+		return
+	}
+
+	props[fieldName] = datastore.Value{
+		StringValue:        fieldValue,
+		ExcludeFromIndexes: noIndex,
 	}
 }
 
-func restorePropertiesValue(fieldName string, props map[string]datastore.Value) string {
-	for attrName, fieldValue := range props {
-		if fieldName == attrName {
-			return fieldValue.StringValue
+// entityValue returns the datastore value of a field that is not stored as
+// text. Zero values are forced to be sent, as the value type would be
+// missing otherwise.
+func entityValue(field reflect.Value) datastore.Value {
+	if field.Kind() == reflect.Ptr {
+		if field.IsNil() {
+			return datastore.Value{NullValue: "NULL_VALUE"}
 		}
+		return entityValue(field.Elem())
 	}
 
-	fieldValue := ""
-	fieldInfos := map[string]string{}
-	for attrName, fieldValue := range props {
-		attrValue := fieldValue.StringValue
-		if strings.Contains(attrName, fieldName+"_") {
-			attrNames := strings.Split(attrName, "_")
-			fieldInfos[attrNames[1]] = attrValue
+	if field.Type() == timeType {
+		return datastore.Value{
+			TimestampValue: field.Interface().(time.Time).UTC().Format(time.RFC3339Nano),
 		}
 	}
 
-	cnt := len(fieldInfos)
-	for i := 1; i <= cnt; i++ {
-		fieldValue = fieldValue + fieldInfos[strconv.Itoa(i)]
+	if field.Type() == bytesType {
+		return datastore.Value{
+			BlobValue:          formatValue(field),
+			ExcludeFromIndexes: true,
+			ForceSendFields:    []string{"BlobValue"},
+		}
+	}
+
+	switch field.Kind() {
+	case reflect.Bool:
+		return datastore.Value{
+			BooleanValue:    field.Bool(),
+			ForceSendFields: []string{"BooleanValue"},
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return datastore.Value{
+			IntegerValue:    field.Int(),
+			ForceSendFields: []string{"IntegerValue"},
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return datastore.Value{
+			IntegerValue:    int64(field.Uint()),
+			ForceSendFields: []string{"IntegerValue"},
+		}
+	default:
+		return datastore.Value{
+			DoubleValue:     field.Float(),
+			ForceSendFields: []string{"DoubleValue"},
+		}
+	}
+}
+
+// setEntityValue loads the properties into the object, decoding the blob of
+// entities stored in blob mode whatever the mode of the store.
+func setEntityValue(object interface{}, props map[string]datastore.Value, compression Compression) error {
+	contentType, ok := props[datastoreContentTypeProperty]
+	if !ok {
+		return recursiveSetEntityValue(object, props)
+	}
+
+	codec, err := codecByContentType(contentType.StringValue)
+	if err != nil {
+		return err
+	}
+
+	b, err := base64.StdEncoding.DecodeString(props[datastoreBlobProperty].BlobValue)
+	if err != nil {
+		return fmt.Errorf("Unable to decode blob: %s", err.Error())
+	}
+
+	if err := decodeObject(codec, compression, b, object); err != nil {
+		return fmt.Errorf("Unable to unmarshal %s blob: %s", contentType.StringValue, err.Error())
+	}
+
+	return nil
+}
+
+func recursiveSetEntityValue(v interface{}, props map[string]datastore.Value) error {
+	err := unflattenFields(v, func(path string, t reflect.Type) (string, bool) {
+		if value, ok := props[path]; ok {
+			return propertyText(t, value), true
+		}
+		return restorePropertiesValue(path, props)
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to set properties to object: %w", err)
+	}
+
+	return nil
+}
+
+// propertyText returns the value as text for parseValue, reading the value
+// type of the field type. Entities stored by older versions hold string
+// values for every type.
+func propertyText(t reflect.Type, value datastore.Value) string {
+	if value.NullValue != "" {
+		return ""
+	}
+
+	if value.StringValue != "" {
+		return value.StringValue
+	}
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == timeType {
+		return value.TimestampValue
+	}
+
+	if t == bytesType {
+		return value.BlobValue
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return strconv.FormatBool(value.BooleanValue)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatInt(value.IntegerValue, 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(value.DoubleValue, 'g', -1, 64)
+	}
+
+	return ""
+}
+
+// restorePropertiesValue joins the parts of a string value that was split
+// into numbered properties by setStringProperties.
+func restorePropertiesValue(fieldName string, props map[string]datastore.Value) (string, bool) {
+	fieldValue := ""
+	i := 1
+	for ; ; i++ {
+		part, ok := props[fmt.Sprintf("%s_%s", fieldName, strconv.Itoa(i))]
+		if !ok {
+			break
+		}
+		fieldValue = fieldValue + part.StringValue
 	}
 
-	return fieldValue
+	return fieldValue, i > 1
 }
 
 func getProjectId(serviceAccountPath string) (string, error) {
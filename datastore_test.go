@@ -1,10 +1,18 @@
 package blobstore
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	datastore "google.golang.org/api/datastore/v1"
 )
 
 var blobStoreConfig *viper.Viper
@@ -27,6 +35,74 @@ func init() {
 	blobStoreConfig = viper
 }
 
+// newTestDatastoreDB returns a datastore store sending its requests to handler.
+func newTestDatastoreDB(t *testing.T, handler http.HandlerFunc) *DatastoreDB {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	datastoreSvc, err := datastore.New(server.Client())
+	assert.Nil(t, err)
+	datastoreSvc.BasePath = server.URL + "/"
+
+	return &DatastoreDB{
+		Name:         testKind,
+		DomainName:   testKind,
+		ProjectId:    testProjectId,
+		datastoreSvc: datastoreSvc,
+	}
+}
+
+func TestDatastoreContextErrors(t *testing.T) {
+	db := newTestDatastoreDB(t, func(w http.ResponseWriter, r *http.Request) {
+		// Responds after the requests are cancelled
+		time.Sleep(200 * time.Millisecond)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := db.LoadContext(ctx, "redis", &TestDeployment{})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "Load should be DeadlineExceeded, got %v", err)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	err = db.StoreContext(ctx, "redis", &TestDeployment{Name: "redis"})
+	assert.True(t, errors.Is(err, context.Canceled), "Store should be Canceled, got %v", err)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err = db.ListKeysPageContext(ctx, "", "", 10)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "ListKeysPage should be DeadlineExceeded, got %v", err)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err = db.LoadPageContext(ctx, func() interface{} { return &TestDeployment{} }, "", 10)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "LoadPage should be DeadlineExceeded, got %v", err)
+}
+
+func TestDatastoreDeleteRequests(t *testing.T) {
+	requests := []string{}
+	found := false
+	db := newTestDatastoreDB(t, func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path[strings.LastIndex(r.URL.Path, ":")+1:])
+		resp := &datastore.LookupResponse{}
+		if found {
+			resp.Found = []*datastore.EntityResult{{Entity: &datastore.Entity{}}}
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+
+	err := db.Delete("missing")
+	assert.True(t, errors.Is(err, ErrNotFound), "Delete should be ErrNotFound, got %v", err)
+	assert.Equal(t, []string{"lookup"}, requests)
+
+	requests, found = nil, true
+	assert.Nil(t, db.Delete("redis"), "Delete error should be nil")
+	assert.Equal(t, []string{"lookup", "commit"}, requests)
+}
+
 func TestGCPDatastore(t *testing.T) {
 	datastoreDB, err := NewDatastoreDB(testKind, blobStoreConfig)
 	if err != nil {
@@ -58,3 +134,50 @@ func TestGCPDatastore(t *testing.T) {
 	err = datastoreDB.Delete(deployment.Name)
 	assert.Nil(t, err, "Datastore delete error should be nil")
 }
+
+func TestDatastoreTypedProperties(t *testing.T) {
+	fields := newTypedFields()
+	props := map[string]datastore.Value{}
+	assert.Nil(t, recursiveEntityProperties(props, fields))
+	assert.Equal(t, int64(-12), props["Int"].IntegerValue)
+	assert.Equal(t, "2017-10-03T12:30:15.123456Z", props["Time"].TimestampValue)
+	assert.Equal(t, "NULL_VALUE", props["NilPtr"].NullValue)
+
+	// Values read back from the API as JSON
+	b, err := json.Marshal(props)
+	assert.Nil(t, err)
+	props = map[string]datastore.Value{}
+	assert.Nil(t, json.Unmarshal(b, &props))
+
+	loaded := &typedFields{}
+	assert.Nil(t, recursiveSetEntityValue(loaded, props))
+	fields.hidden = ""
+	assert.Equal(t, fields, loaded)
+
+	// Entities stored by older versions only have string values
+	legacy := map[string]datastore.Value{
+		"Int":  {StringValue: "5"},
+		"Bool": {StringValue: "true"},
+	}
+	loaded = &typedFields{}
+	assert.Nil(t, recursiveSetEntityValue(loaded, legacy))
+	assert.Equal(t, 5, loaded.Int)
+	assert.True(t, loaded.Bool)
+}
+
+func TestDatastoreNestedProperties(t *testing.T) {
+	fields := newNestedFields()
+	props := map[string]datastore.Value{}
+	assert.Nil(t, recursiveEntityProperties(props, fields))
+	assert.Equal(t, int64(3), props["Spec.Replicas"].IntegerValue)
+	assert.Equal(t, "NULL_VALUE", props["NilSpec"].NullValue)
+
+	b, err := json.Marshal(props)
+	assert.Nil(t, err)
+	props = map[string]datastore.Value{}
+	assert.Nil(t, json.Unmarshal(b, &props))
+
+	loaded := loadNestedFields()
+	assert.Nil(t, recursiveSetEntityValue(loaded, props))
+	assert.Equal(t, fields, loaded)
+}
@@ -1,41 +1,124 @@
 package blobstore
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 )
 
+// Prefix of the temp files written before being renamed into place
+const tempFilePrefix = ".tmp-"
+
 // Store struct to file
 func WriteObjectToFile(path string, object interface{}) error {
-	b, err := json.Marshal(object)
+	return writeObjectToFile(path, object, JSONCodec{}, nil, false)
+}
+
+func writeObjectToFile(path string, object interface{}, codec Codec, compression Compression, syncDir bool) error {
+	b, err := encodeObject(codec, compression, object)
 	if err != nil {
-		return fmt.Errorf("Unable to marshall object to json: %s", err.Error())
+		return err
 	}
 
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0666)
+	return writeFileAtomic(path, b, syncDir)
+}
+
+// writeFileAtomic writes the data to a hidden temp file next to path and
+// renames it over path, see replaceFile.
+func writeFileAtomic(path string, data []byte, syncDir bool) error {
+	file, err := createTempFile(filepath.Dir(path))
 	if err != nil {
-		return fmt.Errorf("Unable to open file path with %s: %s", path, err.Error())
+		return fmt.Errorf("Unable to create temp file for %s: %s", path, err.Error())
 	}
-	defer file.Close()
 
-	_, err = file.Write(b)
-	if err != nil {
+	return replaceFile(file, path, data, syncDir)
+}
+
+// replaceFile writes the data to the temp file, syncs it and renames it over
+// path, so readers and crashes never see a partially written file. If
+// syncDir is set the folder of path is synced too, so the rename itself
+// survives a crash.
+func replaceFile(file *os.File, path string, data []byte, syncDir bool) error {
+	dir := filepath.Dir(path)
+	tempPath := file.Name()
+
+	if err := writeAndSync(file, data); err != nil {
+		file.Close()
+		os.Remove(tempPath)
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("Unable to close temp file: %s", err.Error())
+	}
+
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("Unable to rename temp file to %s: %s", path, err.Error())
+	}
+
+	if syncDir {
+		if err := syncDirectory(dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createTempFile creates a hidden temp file in the folder with the mode of
+// files created by os.Create, unlike ioutil.TempFile which creates them
+// private. The temp name doesn't include the file name, which can already
+// be as long as file names are allowed to be.
+func createTempFile(dir string) (*os.File, error) {
+	for {
+		file, err := os.OpenFile(filepath.Join(dir, tempFilePrefix+newVersion()), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if !os.IsExist(err) {
+			return file, err
+		}
+	}
+}
+
+func writeAndSync(file *os.File, data []byte) error {
+	if _, err := file.Write(data); err != nil {
 		return fmt.Errorf("Unable to write byte array to file: %s", err.Error())
 	}
 
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("Unable to sync file: %s", err.Error())
+	}
+
+	return nil
+}
+
+func syncDirectory(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("Unable to open directory %s: %s", dir, err.Error())
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("Unable to sync directory %s: %s", dir, err.Error())
+	}
+
 	return nil
 }
 
 // Load file to struct
 func LoadFileToObject(path string, object interface{}) error {
+	return loadFileToObject(path, object, JSONCodec{}, nil)
+}
+
+func loadFileToObject(path string, object interface{}, codec Codec, compression Compression) error {
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
-		return fmt.Errorf("Unable to open file path with %s: %s", path, err.Error())
+		return fmt.Errorf("Unable to open file path with %s: %w", path, err)
 	}
 
-	if err := json.Unmarshal(b, object); err != nil {
+	if err := decodeObject(codec, compression, b, object); err != nil {
 		return fmt.Errorf("Unable to decode file to struct: %s", err.Error())
 	}
 
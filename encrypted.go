@@ -0,0 +1,770 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// Data keys and master keys are AES-256 keys
+const encryptionKeyLen = 32
+
+// envelopeMagic starts the encoded envelopes, which can't be mistaken for
+// the start of an object encoded by a codec or a compression header.
+const envelopeMagic = "\xff\x01"
+
+// KeyProvider wraps the data keys of encrypted objects with master keys,
+// which never leave the provider.
+type KeyProvider interface {
+	// WrapKey encrypts the data key with the current master key, and
+	// returns the id of the master key along with the wrapped key.
+	WrapKey(dataKey []byte) (keyID string, wrapped []byte, err error)
+	// UnwrapKey decrypts a data key wrapped with the master key of the id.
+	UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// EncryptedStore wraps a BlobStore so objects are encrypted before they
+// are stored, with envelope encryption: each object is encrypted with AES-GCM
+// using its own random data key, which is stored next to the ciphertext
+// wrapped by a master key of the KeyProvider. The id of the master key is
+// stored too, so master keys can be rotated without losing access to the
+// objects they wrapped, see Rewrap. Objects stored in the wrapped store
+// before it was encrypted can't be loaded until EncryptPlaintext is run.
+// The optional interfaces, like KeyLister or VersionedStore, return an error
+// when the wrapped store doesn't implement them, except BatchStore which
+// falls back to one operation per key.
+type EncryptedStore struct {
+	BlobStore BlobStore
+	Keys      KeyProvider
+	// Codec encodes the objects before encryption, JSON if not set
+	Codec       Codec
+	Compression Compression
+}
+
+// encryptedObject is the envelope stored in the wrapped store.
+type encryptedObject struct {
+	KeyID       string `blobstore:"keyId"`
+	DataKey     []byte `blobstore:"dataKey,noindex"`
+	Nonce       []byte `blobstore:"nonce,noindex"`
+	ContentType string `blobstore:"contentType"`
+	Ciphertext  []byte `blobstore:"ciphertext,noindex"`
+}
+
+func NewEncryptedStore(store BlobStore, keys KeyProvider) *EncryptedStore {
+	return &EncryptedStore{
+		BlobStore: store,
+		Keys:      keys,
+		Codec:     JSONCodec{},
+	}
+}
+
+func (store *EncryptedStore) Store(key string, object interface{}) error {
+	return store.StoreContext(context.Background(), key, object)
+}
+
+func (store *EncryptedStore) StoreContext(ctx context.Context, key string, object interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	envelope, err := store.encrypt(key, object)
+	if err != nil {
+		return err
+	}
+
+	return store.storeEnvelope(ctx, key, envelope)
+}
+
+func (store *EncryptedStore) Load(key string, object interface{}) error {
+	return store.LoadContext(context.Background(), key, object)
+}
+
+func (store *EncryptedStore) LoadContext(ctx context.Context, key string, object interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := validateObject(object); err != nil {
+		return err
+	}
+
+	envelope, err := store.loadEnvelope(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	return store.decrypt(key, envelope, object)
+}
+
+func (store *EncryptedStore) LoadAll(f func() interface{}) (interface{}, error) {
+	return store.LoadAllContext(context.Background(), f)
+}
+
+func (store *EncryptedStore) LoadAllContext(ctx context.Context, f func() interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// The keys are needed to decrypt the objects, see additionalData
+	iterable, ok := store.BlobStore.(Iterable)
+	if !ok {
+		return nil, fmt.Errorf("Unable to load all objects, %T can't iterate its keys", store.BlobStore)
+	}
+
+	items := []interface{}{}
+	err := iterable.Iterate(newEnvelope, func(key string, object interface{}) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		envelope, ok := object.(*encryptedObject)
+		if !ok {
+			return fmt.Errorf("Unable to decrypt %s, unexpected envelope %T: %w", key, object, ErrInvalidObject)
+		}
+
+		v := f()
+		if err := store.decrypt(key, envelope, v); err != nil {
+			return err
+		}
+		items = append(items, v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+func (store *EncryptedStore) Delete(key string) error {
+	return store.DeleteContext(context.Background(), key)
+}
+
+func (store *EncryptedStore) DeleteContext(ctx context.Context, key string) error {
+	if ctxStore, ok := store.BlobStore.(ContextBlobStore); ok {
+		return ctxStore.DeleteContext(ctx, key)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return store.BlobStore.Delete(key)
+}
+
+func (store *EncryptedStore) LoadPage(f func() interface{}, cursor string, limit int) (interface{}, string, error) {
+	return store.LoadPageContext(context.Background(), f, cursor, limit)
+}
+
+func (store *EncryptedStore) LoadPageContext(ctx context.Context, f func() interface{}, cursor string, limit int) (interface{}, string, error) {
+	_, items, next, err := store.loadPage(ctx, f, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return items, next, nil
+}
+
+func (store *EncryptedStore) Iterate(f func() interface{}, fn func(key string, object interface{}) error) error {
+	return iteratePages(context.Background(), store.loadPage, f, fn)
+}
+
+// loadPage lists a page of keys of the wrapped store and decrypts their
+// objects, as the keys are needed to decrypt them. Keys deleted since they
+// were listed are skipped.
+func (store *EncryptedStore) loadPage(ctx context.Context, f func() interface{}, cursor string, limit int) ([]string, []interface{}, string, error) {
+	keys, next, err := store.ListKeysPageContext(ctx, "", cursor, limit)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	envelopes, errs, err := store.loadEnvelopes(ctx, keys)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	loadedKeys := []string{}
+	items := []interface{}{}
+	for i, key := range keys {
+		if errors.Is(errs[i], ErrNotFound) {
+			continue
+		}
+		if errs[i] != nil {
+			return nil, nil, "", errs[i]
+		}
+
+		v := f()
+		if err := store.decrypt(key, envelopes[i], v); err != nil {
+			return nil, nil, "", err
+		}
+		loadedKeys = append(loadedKeys, key)
+		items = append(items, v)
+	}
+
+	return loadedKeys, items, next, nil
+}
+
+func (store *EncryptedStore) ListKeys(prefix string) ([]string, error) {
+	keys, _, err := store.ListKeysPage(prefix, "", 0)
+	return keys, err
+}
+
+func (store *EncryptedStore) ListKeysPage(prefix string, cursor string, limit int) ([]string, string, error) {
+	return store.ListKeysPageContext(context.Background(), prefix, cursor, limit)
+}
+
+func (store *EncryptedStore) ListKeysPageContext(ctx context.Context, prefix string, cursor string, limit int) ([]string, string, error) {
+	if lister, ok := store.BlobStore.(ContextKeyLister); ok {
+		return lister.ListKeysPageContext(ctx, prefix, cursor, limit)
+	}
+
+	lister, ok := store.BlobStore.(KeyLister)
+	if !ok {
+		return nil, "", fmt.Errorf("Unable to list keys, %T can't list its keys", store.BlobStore)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	return lister.ListKeysPage(prefix, cursor, limit)
+}
+
+// Stat describes the envelope stored in the wrapped store, so the size is
+// the size of the encrypted object.
+func (store *EncryptedStore) Stat(key string) (*ObjectInfo, error) {
+	return store.StatContext(context.Background(), key)
+}
+
+func (store *EncryptedStore) StatContext(ctx context.Context, key string) (*ObjectInfo, error) {
+	if stater, ok := store.BlobStore.(ContextStater); ok {
+		return stater.StatContext(ctx, key)
+	}
+
+	stater, ok := store.BlobStore.(Stater)
+	if !ok {
+		return nil, fmt.Errorf("Unable to stat %s, %T can't describe its objects", key, store.BlobStore)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return stater.Stat(key)
+}
+
+func (store *EncryptedStore) Create(key string, object interface{}) error {
+	return store.CreateContext(context.Background(), key, object)
+}
+
+func (store *EncryptedStore) CreateContext(ctx context.Context, key string, object interface{}) error {
+	versioned, ok := store.BlobStore.(VersionedStore)
+	if !ok {
+		return fmt.Errorf("Unable to create %s, %T can't detect concurrent writes", key, store.BlobStore)
+	}
+
+	envelope, err := store.encrypt(key, object)
+	if err != nil {
+		return err
+	}
+
+	if ctxStore, ok := versioned.(ContextVersionedStore); ok {
+		return ctxStore.CreateContext(ctx, key, envelope)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return versioned.Create(key, envelope)
+}
+
+func (store *EncryptedStore) StoreIfVersion(key string, object interface{}, expectedVersion string) error {
+	return store.StoreIfVersionContext(context.Background(), key, object, expectedVersion)
+}
+
+func (store *EncryptedStore) StoreIfVersionContext(ctx context.Context, key string, object interface{}, expectedVersion string) error {
+	versioned, ok := store.BlobStore.(VersionedStore)
+	if !ok {
+		return fmt.Errorf("Unable to store %s, %T can't detect concurrent writes", key, store.BlobStore)
+	}
+
+	envelope, err := store.encrypt(key, object)
+	if err != nil {
+		return err
+	}
+
+	return store.storeEnvelopeIfVersion(ctx, versioned, key, envelope, expectedVersion)
+}
+
+func (store *EncryptedStore) StoreMulti(keys []string, objects []interface{}) error {
+	return store.StoreMultiContext(context.Background(), keys, objects)
+}
+
+func (store *EncryptedStore) StoreMultiContext(ctx context.Context, keys []string, objects []interface{}) error {
+	if err := validateMulti(keys, objects); err != nil {
+		return err
+	}
+
+	errs := make([]error, len(keys))
+	indexes := []int{}
+	batchKeys := []string{}
+	envelopes := []interface{}{}
+	for _, i := range uniqueIndexes(keys, errs) {
+		envelope, err := store.encrypt(keys[i], objects[i])
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		indexes = append(indexes, i)
+		batchKeys = append(batchKeys, keys[i])
+		envelopes = append(envelopes, envelope)
+	}
+
+	batch, ok := store.BlobStore.(BatchStore)
+	if !ok {
+		for j, i := range indexes {
+			errs[i] = store.storeEnvelope(ctx, keys[i], envelopes[j].(*encryptedObject))
+		}
+		return multiError(errs)
+	}
+
+	if len(batchKeys) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var err error
+		if ctxBatch, ok := batch.(ContextBatchStore); ok {
+			err = ctxBatch.StoreMultiContext(ctx, batchKeys, envelopes)
+		} else {
+			err = batch.StoreMulti(batchKeys, envelopes)
+		}
+		if err := spreadMultiError(err, indexes, errs); err != nil {
+			return err
+		}
+	}
+
+	return multiError(errs)
+}
+
+func (store *EncryptedStore) LoadMulti(keys []string, objects []interface{}) error {
+	return store.LoadMultiContext(context.Background(), keys, objects)
+}
+
+func (store *EncryptedStore) LoadMultiContext(ctx context.Context, keys []string, objects []interface{}) error {
+	if err := validateMulti(keys, objects); err != nil {
+		return err
+	}
+
+	envelopes, errs, err := store.loadEnvelopes(ctx, keys)
+	if err != nil {
+		return err
+	}
+
+	for i, key := range keys {
+		if errs[i] != nil {
+			continue
+		}
+		if errs[i] = validateObject(objects[i]); errs[i] == nil {
+			errs[i] = store.decrypt(key, envelopes[i], objects[i])
+		}
+	}
+
+	return multiError(errs)
+}
+
+func (store *EncryptedStore) DeleteMulti(keys []string) error {
+	return store.DeleteMultiContext(context.Background(), keys)
+}
+
+func (store *EncryptedStore) DeleteMultiContext(ctx context.Context, keys []string) error {
+	if batch, ok := store.BlobStore.(ContextBatchStore); ok {
+		return batch.DeleteMultiContext(ctx, keys)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if batch, ok := store.BlobStore.(BatchStore); ok {
+		return batch.DeleteMulti(keys)
+	}
+
+	errs := make([]error, len(keys))
+	for _, i := range uniqueIndexes(keys, errs) {
+		errs[i] = store.DeleteContext(ctx, keys[i])
+	}
+
+	return multiError(errs)
+}
+
+// Rewrap wraps the data key of the key again with the current master key of
+// the KeyProvider, and seals the object again with the same data key, as
+// the id of the master key is authenticated with it. Once every object is
+// rewrapped after a rotation, the previous master key can be retired. If the
+// wrapped store is a VersionedStore, Rewrap returns ErrConflict instead of
+// overwriting an object stored concurrently.
+func (store *EncryptedStore) Rewrap(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	version, err := store.storedVersion(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	envelope, err := store.loadEnvelope(ctx, key)
+	if err != nil {
+		return err
+	}
+	if envelope.KeyID == "" {
+		return notEncryptedError(key)
+	}
+
+	dataKey, err := store.Keys.UnwrapKey(envelope.KeyID, envelope.DataKey)
+	if err != nil {
+		return fmt.Errorf("Unable to unwrap data key of %s with key %s: %s", key, envelope.KeyID, err.Error())
+	}
+
+	plaintext, err := openGCM(dataKey, envelope.Nonce, envelope.Ciphertext, additionalData(key, envelope))
+	if err != nil {
+		return fmt.Errorf("Unable to decrypt %s: %s", key, err.Error())
+	}
+
+	if envelope.KeyID, envelope.DataKey, err = store.Keys.WrapKey(dataKey); err != nil {
+		return fmt.Errorf("Unable to wrap data key: %s", err.Error())
+	}
+
+	if envelope.Nonce, envelope.Ciphertext, err = sealGCM(dataKey, plaintext, additionalData(key, envelope)); err != nil {
+		return fmt.Errorf("Unable to encrypt %s: %s", key, err.Error())
+	}
+
+	return store.replaceEnvelope(ctx, key, envelope, version)
+}
+
+// storedVersion returns the version of the key in the wrapped store, to
+// replace the envelope loaded after it with replaceEnvelope. It's empty if
+// the wrapped store isn't a VersionedStore.
+func (store *EncryptedStore) storedVersion(ctx context.Context, key string) (string, error) {
+	if _, ok := store.BlobStore.(VersionedStore); !ok {
+		return "", nil
+	}
+
+	info, err := store.StatContext(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if !info.Exists {
+		return "", fmt.Errorf("Unable to find %s: %w", key, ErrNotFound)
+	}
+
+	return info.Version, nil
+}
+
+// replaceEnvelope stores the envelope only if the key is still at the
+// version returned by storedVersion, when the wrapped store is a
+// VersionedStore.
+func (store *EncryptedStore) replaceEnvelope(ctx context.Context, key string, envelope *encryptedObject, version string) error {
+	versioned, ok := store.BlobStore.(VersionedStore)
+	if !ok {
+		return store.storeEnvelope(ctx, key, envelope)
+	}
+
+	return store.storeEnvelopeIfVersion(ctx, versioned, key, envelope, version)
+}
+
+func (store *EncryptedStore) storeEnvelopeIfVersion(ctx context.Context, versioned VersionedStore, key string, envelope *encryptedObject, version string) error {
+	if ctxStore, ok := versioned.(ContextVersionedStore); ok {
+		return ctxStore.StoreIfVersionContext(ctx, key, envelope, version)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return versioned.StoreIfVersion(key, envelope, version)
+}
+
+func (store *EncryptedStore) storeEnvelope(ctx context.Context, key string, envelope *encryptedObject) error {
+	if ctxStore, ok := store.BlobStore.(ContextBlobStore); ok {
+		return ctxStore.StoreContext(ctx, key, envelope)
+	}
+	return store.BlobStore.Store(key, envelope)
+}
+
+// EncryptPlaintext encrypts in place the objects of the wrapped store that
+// were stored before it was encrypted, which Load and LoadAll refuse with
+// ErrInvalidObject. The objects are loaded from the wrapped store into the
+// objects created by the factory, so it must be the type they were stored
+// with. Objects stored concurrently are not overwritten if the wrapped store
+// is a VersionedStore.
+func (store *EncryptedStore) EncryptPlaintext(ctx context.Context, f func() interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	iterable, ok := store.BlobStore.(Iterable)
+	if !ok {
+		return fmt.Errorf("Unable to encrypt objects, %T can't iterate its keys", store.BlobStore)
+	}
+
+	// Plaintext objects are loaded as envelopes without a master key id
+	keys := []string{}
+	err := iterable.Iterate(newEnvelope, func(key string, object interface{}) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if envelope, ok := object.(*encryptedObject); !ok || envelope.KeyID == "" {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := store.encryptPlaintext(ctx, key, f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (store *EncryptedStore) encryptPlaintext(ctx context.Context, key string, f func() interface{}) error {
+	version, err := store.storedVersion(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	object := f()
+	if ctxStore, ok := store.BlobStore.(ContextBlobStore); ok {
+		err = ctxStore.LoadContext(ctx, key, object)
+	} else {
+		err = store.BlobStore.Load(key, object)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to load plaintext %s: %w", key, err)
+	}
+
+	envelope, err := store.encrypt(key, object)
+	if err != nil {
+		return err
+	}
+
+	return store.replaceEnvelope(ctx, key, envelope, version)
+}
+
+// envelopeCodec encodes envelopes with the codec of the wrapped store,
+// prefixed by envelopeMagic. Data without the prefix is a plaintext object,
+// which is loaded as an envelope without a master key id instead of being
+// decoded, as the gob codec fails to decode objects of another type.
+// Attribute stores that are not in blob mode map the attributes of
+// plaintext objects to the envelope fields, which leaves the id empty too.
+type envelopeCodec struct {
+	Codec
+}
+
+func (codec envelopeCodec) Marshal(object interface{}) ([]byte, error) {
+	b, err := codec.Codec.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(envelopeMagic), b...), nil
+}
+
+func (codec envelopeCodec) Unmarshal(data []byte, object interface{}) error {
+	envelope, ok := object.(*encryptedObject)
+	if !ok {
+		return fmt.Errorf("Unable to decode %T as an envelope", object)
+	}
+
+	if !bytes.HasPrefix(data, []byte(envelopeMagic)) {
+		*envelope = encryptedObject{}
+		return nil
+	}
+
+	return codec.Codec.Unmarshal(data[len(envelopeMagic):], envelope)
+}
+
+// newEnvelope is the factory of the envelopes loaded from the wrapped store.
+func newEnvelope() interface{} {
+	return &encryptedObject{}
+}
+
+func (store *EncryptedStore) loadEnvelope(ctx context.Context, key string) (*encryptedObject, error) {
+	envelope := &encryptedObject{}
+	if ctxStore, ok := store.BlobStore.(ContextBlobStore); ok {
+		if err := ctxStore.LoadContext(ctx, key, envelope); err != nil {
+			return nil, err
+		}
+	} else if err := store.BlobStore.Load(key, envelope); err != nil {
+		return nil, err
+	}
+
+	return envelope, nil
+}
+
+// loadEnvelopes loads the envelopes of the keys, with the error of each key
+// at the same index, in a single batch if the wrapped store is a BatchStore.
+func (store *EncryptedStore) loadEnvelopes(ctx context.Context, keys []string) ([]*encryptedObject, []error, error) {
+	envelopes := make([]*encryptedObject, len(keys))
+	errs := make([]error, len(keys))
+
+	batch, ok := store.BlobStore.(BatchStore)
+	if !ok {
+		for i, key := range keys {
+			envelopes[i], errs[i] = store.loadEnvelope(ctx, key)
+		}
+		return envelopes, errs, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	objects := make([]interface{}, len(keys))
+	for i := range keys {
+		envelopes[i] = &encryptedObject{}
+		objects[i] = envelopes[i]
+	}
+	if len(keys) > 0 {
+		indexes := make([]int, len(keys))
+		for i := range indexes {
+			indexes[i] = i
+		}
+		var err error
+		if ctxBatch, ok := batch.(ContextBatchStore); ok {
+			err = ctxBatch.LoadMultiContext(ctx, keys, objects)
+		} else {
+			err = batch.LoadMulti(keys, objects)
+		}
+		if err := spreadMultiError(err, indexes, errs); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return envelopes, errs, nil
+}
+
+func (store *EncryptedStore) codec() Codec {
+	if store.Codec == nil {
+		return JSONCodec{}
+	}
+	return store.Codec
+}
+
+// additionalData returns the data authenticated along with the object,
+// which binds the envelope to its key, so it can't be copied to another key,
+// and to the master key and wrapped data key it was sealed with.
+func additionalData(key string, envelope *encryptedObject) []byte {
+	return []byte(key + "\x00" + envelope.KeyID + "\x00" + envelope.ContentType + "\x00" + string(envelope.DataKey))
+}
+
+// encrypt encodes the object and encrypts it with a new data key.
+func (store *EncryptedStore) encrypt(key string, object interface{}) (*encryptedObject, error) {
+	plaintext, err := encodeObject(store.codec(), store.Compression, object)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey := make([]byte, encryptionKeyLen)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("Unable to generate data key: %s", err.Error())
+	}
+
+	envelope := &encryptedObject{
+		ContentType: messageCodec(store.codec(), object).ContentType(),
+	}
+	if envelope.KeyID, envelope.DataKey, err = store.Keys.WrapKey(dataKey); err != nil {
+		return nil, fmt.Errorf("Unable to wrap data key: %s", err.Error())
+	}
+
+	if envelope.Nonce, envelope.Ciphertext, err = sealGCM(dataKey, plaintext, additionalData(key, envelope)); err != nil {
+		return nil, fmt.Errorf("Unable to encrypt object: %s", err.Error())
+	}
+
+	return envelope, nil
+}
+
+// decrypt decrypts the envelope and decodes it into the object, with the
+// codec the object was encoded with.
+func (store *EncryptedStore) decrypt(key string, envelope *encryptedObject, object interface{}) error {
+	if envelope.KeyID == "" {
+		return notEncryptedError(key)
+	}
+
+	dataKey, err := store.Keys.UnwrapKey(envelope.KeyID, envelope.DataKey)
+	if err != nil {
+		return fmt.Errorf("Unable to unwrap data key of %s with key %s: %s", key, envelope.KeyID, err.Error())
+	}
+
+	plaintext, err := openGCM(dataKey, envelope.Nonce, envelope.Ciphertext, additionalData(key, envelope))
+	if err != nil {
+		return fmt.Errorf("Unable to decrypt %s: %s", key, err.Error())
+	}
+
+	codec, err := codecByContentType(envelope.ContentType)
+	if err != nil {
+		return fmt.Errorf("Unable to decode %s: %w", key, err)
+	}
+
+	if err := decodeObject(codec, store.Compression, plaintext, object); err != nil {
+		return fmt.Errorf("Unable to decode %s: %w", key, err)
+	}
+
+	return nil
+}
+
+// notEncryptedError is returned for the objects stored before the store was
+// encrypted, which are loaded as envelopes without a master key id.
+func notEncryptedError(key string) error {
+	return fmt.Errorf("Unable to decrypt %s, it's not encrypted, see EncryptPlaintext: %w", key, ErrInvalidObject)
+}
+
+// sealGCM encrypts and authenticates the plaintext and the additional data
+// with AES-GCM, and returns the random nonce and the ciphertext.
+func sealGCM(key []byte, plaintext []byte, additionalData []byte) ([]byte, []byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, fmt.Errorf("Unable to generate nonce: %s", err.Error())
+	}
+
+	return nonce, gcm.Seal(nil, nonce, plaintext, additionalData), nil
+}
+
+func openGCM(key []byte, nonce []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("Invalid nonce length %d", len(nonce))
+	}
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt ciphertext: %s", err.Error())
+	}
+
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create cipher: %s", err.Error())
+	}
+
+	return cipher.NewGCM(block)
+}
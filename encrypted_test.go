@@ -0,0 +1,306 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func newMasterKey() string {
+	key := make([]byte, encryptionKeyLen)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func writeKeyFile(t *testing.T, currentKeyID string, keys map[string]string) string {
+	b, err := json.Marshal(keyFile{CurrentKeyID: currentKeyID, Keys: keys})
+	assert.Nil(t, err)
+
+	keyPath := path.Join(t.TempDir(), "keys.json")
+	assert.Nil(t, ioutil.WriteFile(keyPath, b, 0600))
+	return keyPath
+}
+
+func newEncryptedMemoryStore(t *testing.T) (*EncryptedStore, *MemoryStore) {
+	keys, err := NewKeyFileProvider(writeKeyFile(t, "first", map[string]string{"first": newMasterKey()}), false)
+	assert.Nil(t, err)
+
+	memory, err := NewMemory("testStore", nil)
+	assert.Nil(t, err)
+
+	return NewEncryptedStore(memory, keys), memory
+}
+
+func TestEncryptedStore(t *testing.T) {
+	store, memory := newEncryptedMemoryStore(t)
+	fields := newTaggedFields()
+	assert.Nil(t, store.Store("redis", fields), "Store error should be nil")
+
+	// The wrapped store only sees the envelope
+	envelope := &encryptedObject{}
+	assert.Nil(t, memory.Load("redis", envelope))
+	assert.Equal(t, "first", envelope.KeyID)
+	assert.Equal(t, "application/json", envelope.ContentType)
+	assert.False(t, bytes.Contains(envelope.Ciphertext, []byte("us-east-1")))
+
+	loaded := &taggedFields{}
+	assert.Nil(t, store.Load("redis", loaded), "Load error should be nil")
+	assert.Equal(t, fields, loaded)
+
+	items, err := store.LoadAll(func() interface{} { return &taggedFields{} })
+	assert.Nil(t, err, "LoadAll error should be nil")
+	assert.Equal(t, []interface{}{fields}, items)
+
+	// Data keys are not reused across objects
+	assert.Nil(t, store.Store("mysql", fields), "Store error should be nil")
+	other := &encryptedObject{}
+	assert.Nil(t, memory.Load("mysql", other))
+	assert.NotEqual(t, envelope.DataKey, other.DataKey)
+	assert.NotEqual(t, envelope.Ciphertext, other.Ciphertext)
+}
+
+func TestEncryptedStoreTampering(t *testing.T) {
+	store, memory := newEncryptedMemoryStore(t)
+	assert.Nil(t, store.Store("redis", newTaggedFields()), "Store error should be nil")
+
+	envelope := &encryptedObject{}
+	assert.Nil(t, memory.Load("redis", envelope))
+	envelope.Ciphertext[0] ^= 1
+	assert.Nil(t, memory.Store("redis", envelope))
+	assert.NotNil(t, store.Load("redis", &taggedFields{}), "Tampered ciphertext should not decrypt")
+
+	// The content type is authenticated too
+	assert.Nil(t, store.Store("redis", newTaggedFields()), "Store error should be nil")
+	assert.Nil(t, memory.Load("redis", envelope))
+	envelope.ContentType = "application/cbor"
+	assert.Nil(t, memory.Store("redis", envelope))
+	assert.NotNil(t, store.Load("redis", &taggedFields{}), "Tampered content type should not decrypt")
+
+	// Envelopes can't be copied to another key
+	assert.Nil(t, store.Store("redis", newTaggedFields()), "Store error should be nil")
+	assert.Nil(t, store.Store("mysql", &taggedFields{Name: "mysql"}), "Store error should be nil")
+	assert.Nil(t, memory.Load("redis", envelope))
+	assert.Nil(t, memory.Store("mysql", envelope))
+	assert.NotNil(t, store.Load("mysql", &taggedFields{}), "Envelope of another key should not decrypt")
+	_, err := store.LoadAll(func() interface{} { return &taggedFields{} })
+	assert.NotNil(t, err, "Envelope of another key should not decrypt")
+
+	// Nor can the wrapped data key of another object be swapped in
+	other := &encryptedObject{}
+	assert.Nil(t, store.Store("mysql", &taggedFields{Name: "mysql"}), "Store error should be nil")
+	assert.Nil(t, memory.Load("mysql", other))
+	envelope.DataKey = other.DataKey
+	assert.Nil(t, memory.Store("redis", envelope))
+	assert.NotNil(t, store.Load("redis", &taggedFields{}), "Swapped data key should not decrypt")
+}
+
+func TestEncryptedStorePlaintext(t *testing.T) {
+	// Gob fails to decode objects into envelopes, see envelopeCodec
+	for _, name := range []string{"json", "gob"} {
+		t.Run(name, func(t *testing.T) {
+			store, memory := newEncryptedMemoryStore(t)
+			store.Codec = codecs[name]
+			memory.Codec = codecs[name]
+			fields := newTaggedFields()
+			assert.Nil(t, store.Store("mysql", fields), "Store error should be nil")
+
+			// Objects stored before the store was encrypted are refused
+			plaintext := &taggedFields{Name: "redis"}
+			assert.Nil(t, memory.Store("redis", plaintext))
+			err := store.Load("redis", &taggedFields{})
+			assert.True(t, errors.Is(err, ErrInvalidObject), "Plaintext Load should be ErrInvalidObject, got %v", err)
+			_, err = store.LoadAll(func() interface{} { return &taggedFields{} })
+			assert.True(t, errors.Is(err, ErrInvalidObject), "Plaintext LoadAll should be ErrInvalidObject, got %v", err)
+
+			// Until they are encrypted in place
+			assert.Nil(t, store.EncryptPlaintext(context.Background(), func() interface{} { return &taggedFields{} }))
+			envelope := &encryptedObject{}
+			assert.Nil(t, memory.Load("redis", envelope))
+			assert.Equal(t, "first", envelope.KeyID)
+			loaded := &taggedFields{}
+			assert.Nil(t, store.Load("redis", loaded), "Load error should be nil")
+			assert.Equal(t, plaintext, loaded)
+			loaded = &taggedFields{}
+			assert.Nil(t, store.Load("mysql", loaded), "Load error should be nil")
+			assert.Equal(t, fields, loaded)
+
+			items, err := store.LoadAll(func() interface{} { return &taggedFields{} })
+			assert.Nil(t, err, "LoadAll error should be nil")
+			assert.Len(t, items, 2)
+		})
+	}
+}
+
+// basicStore hides the optional interfaces of the wrapped store.
+type basicStore struct {
+	BlobStore
+}
+
+func TestEncryptedStoreBasicStore(t *testing.T) {
+	store, memory := newEncryptedMemoryStore(t)
+	store.BlobStore = basicStore{memory}
+
+	// Optional interfaces the wrapped store lacks are refused
+	_, err := store.ListKeys("")
+	assert.NotNil(t, err, "ListKeys should fail without a KeyLister")
+	_, err = store.Stat("redis")
+	assert.NotNil(t, err, "Stat should fail without a Stater")
+	assert.NotNil(t, store.Create("redis", newTaggedFields()), "Create should fail without a VersionedStore")
+
+	// Batches fall back to one operation per key
+	fields := newTaggedFields()
+	assert.Nil(t, store.StoreMulti([]string{"redis", "mysql"}, []interface{}{fields, fields}))
+	loaded := []interface{}{&taggedFields{}, &taggedFields{}}
+	assert.Nil(t, store.LoadMulti([]string{"redis", "mysql"}, loaded))
+	assert.Equal(t, []interface{}{fields, fields}, loaded)
+	assert.Nil(t, store.DeleteMulti([]string{"redis", "mysql"}))
+	keys, err := memory.ListKeys("")
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestEncryptedStoreKeyRotation(t *testing.T) {
+	first, second := newMasterKey(), newMasterKey()
+	keys, err := NewKeyFileProvider(writeKeyFile(t, "first", map[string]string{"first": first}), false)
+	assert.Nil(t, err)
+	memory, err := NewMemory("testStore", nil)
+	assert.Nil(t, err)
+
+	store := NewEncryptedStore(memory, keys)
+	fields := newTaggedFields()
+	assert.Nil(t, store.Store("redis", fields), "Store error should be nil")
+
+	// Objects wrapped with the previous key are still readable
+	store.Keys, err = NewKeyFileProvider(writeKeyFile(t, "second", map[string]string{"first": first, "second": second}), false)
+	assert.Nil(t, err)
+	loaded := &taggedFields{}
+	assert.Nil(t, store.Load("redis", loaded), "Load error should be nil")
+	assert.Equal(t, fields, loaded)
+
+	assert.Nil(t, store.Rewrap(context.Background(), "redis"), "Rewrap error should be nil")
+	envelope := &encryptedObject{}
+	assert.Nil(t, memory.Load("redis", envelope))
+	assert.Equal(t, "second", envelope.KeyID)
+
+	// Objects stored while they are rewrapped are not overwritten
+	racing := &racingStore{MemoryStore: memory}
+	store.BlobStore = racing
+	stored := &taggedFields{Name: "stored"}
+	racing.onLoad = func() {
+		racing.onLoad = nil
+		assert.Nil(t, store.Store("redis", stored), "Store error should be nil")
+	}
+	err = store.Rewrap(context.Background(), "redis")
+	assert.True(t, errors.Is(err, ErrConflict), "Concurrent Rewrap should be ErrConflict, got %v", err)
+	loaded = &taggedFields{}
+	assert.Nil(t, store.Load("redis", loaded), "Load error should be nil")
+	assert.Equal(t, stored, loaded)
+	store.BlobStore = memory
+
+	// The previous key can be retired once every object is rewrapped
+	store.Keys, err = NewKeyFileProvider(writeKeyFile(t, "second", map[string]string{"second": second}), false)
+	assert.Nil(t, err)
+	loaded = &taggedFields{}
+	assert.Nil(t, store.Load("redis", loaded), "Load error should be nil")
+	assert.Equal(t, stored, loaded)
+}
+
+// racingStore calls onLoad before loading a key, to store concurrently.
+type racingStore struct {
+	*MemoryStore
+	onLoad func()
+}
+
+func (racing *racingStore) LoadContext(ctx context.Context, key string, object interface{}) error {
+	if racing.onLoad != nil {
+		racing.onLoad()
+	}
+	return racing.MemoryStore.LoadContext(ctx, key, object)
+}
+
+func TestKeyFileProvider(t *testing.T) {
+	_, err := NewKeyFileProvider(writeKeyFile(t, "missing", map[string]string{"first": newMasterKey()}), false)
+	assert.NotNil(t, err, "Current key should be in the key file")
+
+	_, err = NewKeyFileProvider(writeKeyFile(t, "short", map[string]string{"short": "c2hvcnQ="}), false)
+	assert.NotNil(t, err, "Keys should be 32 bytes")
+
+	// Key files accessible by other users are refused unless allowed
+	keyPath := writeKeyFile(t, "first", map[string]string{"first": newMasterKey()})
+	assert.Nil(t, os.Chmod(keyPath, 0644))
+	_, err = NewKeyFileProvider(keyPath, false)
+	assert.NotNil(t, err, "Readable key file should be refused")
+	_, err = NewKeyFileProvider(keyPath, true)
+	assert.Nil(t, err, "Readable key file should be allowed")
+
+	keys, err := NewKeyFileProvider(writeKeyFile(t, "first", map[string]string{"first": newMasterKey()}), false)
+	assert.Nil(t, err)
+	keyID, wrapped, err := keys.WrapKey([]byte("data key"))
+	assert.Nil(t, err)
+	_, err = keys.UnwrapKey("other", wrapped)
+	assert.NotNil(t, err)
+	dataKey, err := keys.UnwrapKey(keyID, wrapped)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("data key"), dataKey)
+}
+
+func TestEncryptedBlobStoreCompression(t *testing.T) {
+	config := viper.New()
+	config.Set("store.type", "file")
+	config.Set("filesPath", t.TempDir())
+	config.Set("store.compression", "gzip")
+	config.Set("store.encryptionKeyFile", writeKeyFile(t, "first", map[string]string{"first": newMasterKey()}))
+	store, err := NewBlobStore("testStore", config)
+	assert.Nil(t, err)
+
+	// Objects are compressed before encryption, not the ciphertext after
+	encrypted := store.(*EncryptedStore)
+	assert.Equal(t, GzipCompression{}, encrypted.Compression)
+	file := encrypted.BlobStore.(*FileStore)
+	assert.Nil(t, file.Compression)
+
+	fields := &taggedFields{Notes: strings.Repeat("compressible ", 1000)}
+	assert.Nil(t, store.Store("redis", fields), "Store error should be nil")
+	envelope := &encryptedObject{}
+	assert.Nil(t, file.Load("redis", envelope))
+	assert.True(t, len(envelope.Ciphertext) < len(fields.Notes)/10, "Ciphertext of %d bytes should be compressed", len(envelope.Ciphertext))
+
+	loaded := &taggedFields{}
+	assert.Nil(t, store.Load("redis", loaded), "Load error should be nil")
+	assert.Equal(t, fields, loaded)
+}
+
+func TestEncryptedBlobStoreConfig(t *testing.T) {
+	config := viper.New()
+	config.Set("store.type", "file")
+	config.Set("filesPath", t.TempDir())
+	config.Set("store.codec", "msgpack")
+	config.Set("store.encryptionKeyFile", writeKeyFile(t, "first", map[string]string{"first": newMasterKey()}))
+	store, err := NewBlobStore("testStore", config)
+	assert.Nil(t, err)
+
+	encrypted, ok := store.(*EncryptedStore)
+	if assert.True(t, ok, "Store should be encrypted") {
+		assert.Equal(t, MsgpackCodec{}, encrypted.Codec)
+		assert.IsType(t, &FileStore{}, encrypted.BlobStore)
+	}
+
+	fields := newTaggedFields()
+	assert.Nil(t, store.Store("redis", fields), "Store error should be nil")
+	loaded := &taggedFields{}
+	assert.Nil(t, store.Load("redis", loaded), "Load error should be nil")
+	assert.Equal(t, fields, loaded)
+}
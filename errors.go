@@ -0,0 +1,147 @@
+package blobstore
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Errors returned by all stores. Stores wrap them with more details, so
+// callers should compare with errors.Is.
+var (
+	// ErrNotFound is returned when the key doesn't exist in the store.
+	ErrNotFound = errors.New("Key not found")
+	// ErrInvalidKey is returned when the key can't be used by the store.
+	ErrInvalidKey = errors.New("Invalid key")
+	// ErrInvalidObject is returned when the object can't be loaded into.
+	ErrInvalidObject = errors.New("Invalid object")
+	// ErrConflict is returned when a write conflicts with the stored value.
+	ErrConflict = errors.New("Conflict with stored value")
+	// ErrStopIteration can be returned by an Iterate callback to stop
+	// iterating without Iterate returning an error.
+	ErrStopIteration = errors.New("Stop iteration")
+)
+
+// validateKey checks the key is not empty and, if maxLen is positive,
+// not longer than maxLen bytes.
+func validateKey(key string, maxLen int) error {
+	if key == "" {
+		return fmt.Errorf("Key can't be empty: %w", ErrInvalidKey)
+	}
+
+	if maxLen > 0 && len(key) > maxLen {
+		return fmt.Errorf("Key can't be longer than %d bytes: %w", maxLen, ErrInvalidKey)
+	}
+
+	return nil
+}
+
+// validateObject checks the object is a non nil pointer that can be loaded into.
+func validateObject(object interface{}) error {
+	if object == nil {
+		return fmt.Errorf("Unable to load to nil object: %w", ErrInvalidObject)
+	}
+
+	v := reflect.ValueOf(object)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("Unable to load to non pointer or nil object %T: %w", object, ErrInvalidObject)
+	}
+
+	return nil
+}
+
+// MultiError is returned by the batch operations when some keys failed,
+// with the error of each key at the same index as the key and nil for
+// the keys that succeeded.
+type MultiError []error
+
+func (m MultiError) Error() string {
+	count, first := 0, ""
+	for _, err := range m {
+		if err != nil {
+			if count == 0 {
+				first = err.Error()
+			}
+			count++
+		}
+	}
+
+	switch count {
+	case 0:
+		return "No errors"
+	case 1:
+		return first
+	default:
+		return fmt.Sprintf("%s (and %d other errors)", first, count-1)
+	}
+}
+
+// Unwrap allows errors.Is to match the error of any key.
+func (m MultiError) Unwrap() []error {
+	errs := []error{}
+	for _, err := range m {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// multiError returns errs as a MultiError if any of them is not nil.
+func multiError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return MultiError(errs)
+		}
+	}
+	return nil
+}
+
+// spreadMultiError sets the errors of a batch of some of the keys, at the
+// indexes of the batch keys. It returns the error if it's not a MultiError of
+// the batch, as the whole batch failed.
+func spreadMultiError(err error, indexes []int, errs []error) error {
+	if err == nil {
+		return nil
+	}
+
+	multiErr, ok := err.(MultiError)
+	if !ok || len(multiErr) != len(indexes) {
+		return err
+	}
+
+	for j, i := range indexes {
+		errs[i] = multiErr[j]
+	}
+	return nil
+}
+
+func validateMulti(keys []string, objects []interface{}) error {
+	if len(keys) != len(objects) {
+		return fmt.Errorf("Keys and objects length mismatch: %d != %d", len(keys), len(objects))
+	}
+	return nil
+}
+
+// uniqueIndexes sets ErrInvalidKey in errs for the keys that repeat an
+// earlier key of the batch, which the batch requests of SimpleDB and
+// Datastore reject, and returns the indexes of the keys without an error.
+// The file and memory stores reject them too so batches fail the same way
+// in every store.
+func uniqueIndexes(keys []string, errs []error) []int {
+	indexes := []int{}
+	seen := map[string]bool{}
+	for i, key := range keys {
+		if errs[i] != nil {
+			continue
+		}
+		if seen[key] {
+			errs[i] = fmt.Errorf("Key %s is repeated in the batch: %w", key, ErrInvalidKey)
+			continue
+		}
+		seen[key] = true
+		indexes = append(indexes, i)
+	}
+
+	return indexes
+}
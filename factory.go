@@ -1,8 +1,10 @@
 package blobstore
 
 import (
+	"context"
 	"errors"
 	"strings"
+	"time"
 )
 
 type BlobStore interface {
@@ -11,16 +13,200 @@ type BlobStore interface {
 	// specific type. Users will have to assume the interface{} is a array type of
 	// objects created by the factory func.
 	// Factory is the function to create a per typed interface object
+	// See TypedStore for a type safe wrapper.
 	LoadAll(factory func() interface{}) (interface{}, error)
 	Load(key string, object interface{}) error
 	Delete(key string) error
 }
 
+// ContextBlobStore is a BlobStore whose operations can be cancelled or bound
+// to a deadline through a context. All stores returned by NewBlobStore
+// implement it.
+type ContextBlobStore interface {
+	BlobStore
+	StoreContext(ctx context.Context, key string, object interface{}) error
+	LoadAllContext(ctx context.Context, factory func() interface{}) (interface{}, error)
+	LoadContext(ctx context.Context, key string, object interface{}) error
+	DeleteContext(ctx context.Context, key string) error
+}
+
+// KeyLister is implemented by stores that can list their keys without
+// loading the objects. Keys are returned in ascending order.
+type KeyLister interface {
+	ListKeys(prefix string) ([]string, error)
+	// ListKeysPage returns up to limit keys with the prefix, starting after the
+	// cursor returned by the previous page. An empty cursor starts from the
+	// first key, and an empty returned cursor means there are no more keys.
+	ListKeysPage(prefix string, cursor string, limit int) ([]string, string, error)
+}
+
+// ContextKeyLister is a KeyLister whose pages can be cancelled or bound to
+// a deadline through a context. All stores returned by NewBlobStore
+// implement it.
+type ContextKeyLister interface {
+	KeyLister
+	ListKeysPageContext(ctx context.Context, prefix string, cursor string, limit int) ([]string, string, error)
+}
+
+// PageLoader is implemented by stores that can load their objects a page at a time.
+type PageLoader interface {
+	// LoadPage returns up to limit objects created by the factory, as a
+	// []interface{} like LoadAll, starting after the cursor returned by the
+	// previous page. An empty cursor starts from the first object, and an
+	// empty returned cursor means there are no more objects.
+	LoadPage(factory func() interface{}, cursor string, limit int) (interface{}, string, error)
+}
+
+// ContextPageLoader is a PageLoader whose pages can be cancelled or bound to
+// a deadline through a context. All stores returned by NewBlobStore
+// implement it.
+type ContextPageLoader interface {
+	PageLoader
+	LoadPageContext(ctx context.Context, factory func() interface{}, cursor string, limit int) (interface{}, string, error)
+}
+
+// Iterable is implemented by stores that can stream their objects one at a
+// time instead of loading them all in memory.
+type Iterable interface {
+	// Iterate calls fn with the key and the object created by the factory for
+	// every object in the store. Iteration stops at the first error returned
+	// by fn, which Iterate returns unless it's ErrStopIteration.
+	Iterate(factory func() interface{}, fn func(key string, object interface{}) error) error
+}
+
+// ObjectInfo describes a stored object. Fields a store doesn't track are
+// left to their zero value.
+type ObjectInfo struct {
+	Key    string
+	Exists bool
+	// Size of the stored value in bytes
+	Size    int64
+	ModTime time.Time
+	// Version changes every time the object is stored
+	Version string
+	// Number of attributes the object is stored as, for attribute based stores
+	Attributes int
+}
+
+// Stater is implemented by stores that can describe an object without loading it.
+type Stater interface {
+	// Stat returns the object info of the key, with Exists set to false
+	// and no error if the key doesn't exist.
+	Stat(key string) (*ObjectInfo, error)
+}
+
+// BatchStore is implemented by stores that can store, load and delete
+// multiple keys with fewer round trips. When only some keys fail, the
+// operations return a MultiError with the error of each key.
+type BatchStore interface {
+	StoreMulti(keys []string, objects []interface{}) error
+	LoadMulti(keys []string, objects []interface{}) error
+	DeleteMulti(keys []string) error
+}
+
+// VersionedStore is implemented by stores that can detect concurrent writes
+// to the same key, using the versions returned by Stat.
+type VersionedStore interface {
+	Stater
+	// Create stores the object only if the key doesn't exist, and returns
+	// ErrConflict otherwise.
+	Create(key string, object interface{}) error
+	// StoreIfVersion stores the object only if the stored version of the key
+	// is expectedVersion. It returns ErrNotFound if the key doesn't exist and
+	// ErrConflict if the version changed.
+	StoreIfVersion(key string, object interface{}, expectedVersion string) error
+}
+
+// ContextStater is a Stater whose calls can be cancelled or bound to a
+// deadline through a context. All stores returned by NewBlobStore
+// implement it.
+type ContextStater interface {
+	Stater
+	StatContext(ctx context.Context, key string) (*ObjectInfo, error)
+}
+
+// ContextBatchStore is a BatchStore whose operations can be cancelled or
+// bound to a deadline through a context. All stores returned by
+// NewBlobStore implement it.
+type ContextBatchStore interface {
+	BatchStore
+	StoreMultiContext(ctx context.Context, keys []string, objects []interface{}) error
+	LoadMultiContext(ctx context.Context, keys []string, objects []interface{}) error
+	DeleteMultiContext(ctx context.Context, keys []string) error
+}
+
+// ContextVersionedStore is a VersionedStore whose writes can be cancelled
+// or bound to a deadline through a context. All stores returned by
+// NewBlobStore implement it.
+type ContextVersionedStore interface {
+	VersionedStore
+	ContextStater
+	CreateContext(ctx context.Context, key string, object interface{}) error
+	StoreIfVersionContext(ctx context.Context, key string, object interface{}, expectedVersion string) error
+}
+
 type BlobStoreConfig interface {
 	GetString(name string) string
 }
 
 func NewBlobStore(name string, config BlobStoreConfig) (BlobStore, error) {
+	return NewContextBlobStore(name, config)
+}
+
+// NewContextBlobStore returns the store of the store.type setting. If
+// store.encryptionKeyFile is set, the store is wrapped in an EncryptedStore
+// using the master keys of the key file, which other users can only access
+// if store.allowReadableKeyFile is set. The EncryptedStore compresses the
+// objects before encrypting them, as ciphertext doesn't compress.
+func NewContextBlobStore(name string, config BlobStoreConfig) (ContextBlobStore, error) {
+	keyFile := config.GetString("store.encryptionKeyFile")
+	if keyFile == "" {
+		return newContextBlobStore(name, config)
+	}
+
+	store, err := newContextBlobStore(name, overrideConfig{
+		BlobStoreConfig: config,
+		overrides:       map[string]string{"store.compression": "none"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := NewKeyFileProvider(keyFile, getConfigBool(config, "store.allowReadableKeyFile"))
+	if err != nil {
+		return nil, errors.New("Unable to load encryption keys: " + err.Error())
+	}
+
+	codec, err := NewCodec(config)
+	if err != nil {
+		return nil, err
+	}
+
+	compression, err := NewCompression(config)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := NewEncryptedStore(store, keys)
+	encrypted.Codec = codec
+	encrypted.Compression = compression
+	return encrypted, nil
+}
+
+// overrideConfig overrides some settings of the config.
+type overrideConfig struct {
+	BlobStoreConfig
+	overrides map[string]string
+}
+
+func (config overrideConfig) GetString(name string) string {
+	if value, ok := config.overrides[name]; ok {
+		return value
+	}
+	return config.BlobStoreConfig.GetString(name)
+}
+
+func newContextBlobStore(name string, config BlobStoreConfig) (ContextBlobStore, error) {
 	storeType := strings.ToLower(config.GetString("store.type"))
 	switch storeType {
 	case "simpledb":
@@ -29,6 +215,8 @@ func NewBlobStore(name string, config BlobStoreConfig) (BlobStore, error) {
 		return NewFile(name, config)
 	case "datastore":
 		return NewDatastoreDB(name, config)
+	case "memory":
+		return NewMemory(name, config)
 	default:
 		return nil, errors.New("Unsupported store type: " + storeType)
 	}
@@ -1,89 +1,582 @@
 package blobstore
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
-	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 )
 
 // File store saves each key value as a seperate file in the folder
 // that's specified in the Path
 // This is meant to be used only for local testing and usage.
+// Processes sharing the folder on one host are synchronized with advisory
+// flock locks on hidden lock files in the folder. Reads of any keys run in
+// parallel, writes only exclude other operations on the keys sharing one of
+// a fixed number of lock stripes.
+// Files are written to the temp file of their lock stripe and renamed into
+// place, and SyncDir
+// also syncs the folder after each write for durability across crashes.
+// With a ShardDepth, files are written to nested hash prefix folders so
+// no folder holds too many files, see Rebalance. With a Compression, files
+// are compressed, and files written without it can still be read.
 type FileStore struct {
-	Name  string
-	Path  string
-	mutex sync.Mutex
+	Name       string
+	Path       string
+	SyncDir    bool
+	ShardDepth int
+	// Codec encodes the files, JSON if not set
+	Codec       Codec
+	Compression Compression
+	// In process locks, matching the flock locks of the folder and the key
+	// stripes
+	mutex   sync.RWMutex
+	stripes [fileLockStripes]sync.RWMutex
 }
 
 func NewFile(name string, config BlobStoreConfig) (*FileStore, error) {
 	Path := path.Join(config.GetString("filesPath"), name)
 	os.MkdirAll(Path, os.ModePerm)
-	return &FileStore{
-		Name: name,
-		Path: Path,
-	}, nil
+	shardDepth, err := getConfigInt(config, "store.shardDepth")
+	if err != nil {
+		return nil, errors.New("Unable to parse shard depth: " + err.Error())
+	}
+	if shardDepth < 0 || shardDepth > fileMaxShardDepth {
+		return nil, fmt.Errorf("Shard depth must be between 0 and %d", fileMaxShardDepth)
+	}
+
+	codec, err := NewCodec(config)
+	if err != nil {
+		return nil, err
+	}
+
+	compression, err := NewCompression(config)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &FileStore{
+		Name:        name,
+		Path:        Path,
+		SyncDir:     getConfigBool(config, "store.syncDir"),
+		ShardDepth:  shardDepth,
+		Codec:       codec,
+		Compression: compression,
+	}
+
+	if err := file.Migrate(); err != nil {
+		return nil, errors.New("Unable to migrate file store: " + err.Error())
+	}
+
+	if err := file.checkShardDepth(); err != nil {
+		return nil, err
+	}
+
+	return file, nil
 }
 
 func (file *FileStore) Store(key string, object interface{}) error {
-	file.mutex.Lock()
-	defer file.mutex.Unlock()
+	return file.StoreContext(context.Background(), key, object)
+}
+
+func (file *FileStore) StoreContext(ctx context.Context, key string, object interface{}) error {
+	return file.store(ctx, key, object, nil)
+}
+
+func (file *FileStore) Create(key string, object interface{}) error {
+	return file.CreateContext(context.Background(), key, object)
+}
+
+func (file *FileStore) CreateContext(ctx context.Context, key string, object interface{}) error {
+	return file.store(ctx, key, object, func(exists bool, version string) error {
+		if exists {
+			return fmt.Errorf("Unable to create %s, file already exists: %w", key, ErrConflict)
+		}
+		return nil
+	})
+}
+
+func (file *FileStore) StoreIfVersion(key string, object interface{}, expectedVersion string) error {
+	return file.StoreIfVersionContext(context.Background(), key, object, expectedVersion)
+}
+
+func (file *FileStore) StoreIfVersionContext(ctx context.Context, key string, object interface{}, expectedVersion string) error {
+	return file.store(ctx, key, object, func(exists bool, version string) error {
+		if !exists {
+			return fmt.Errorf("Unable to find %s file: %w", key, ErrNotFound)
+		}
+		if version != expectedVersion {
+			return fmt.Errorf("Unable to store %s, version %s is not %s: %w", key, version, expectedVersion, ErrConflict)
+		}
+		return nil
+	})
+}
 
-	filePath := path.Join(file.Path, key)
-	if err := WriteObjectToFile(filePath, object); err != nil {
+// store writes the object to the key file and bumps its version, unless
+// check, which is called with the current state of the key while holding
+// the lock, returns an error.
+func (file *FileStore) store(ctx context.Context, key string, object interface{}, check func(exists bool, version string) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := validateFileKey(key); err != nil {
+		return err
+	}
+
+	unlock, err := file.lockKey(key, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	dir, storeDir, exists, err := file.locateKey(key)
+	if err != nil {
+		return err
+	}
+
+	version, err := file.readVersion(dir, key)
+	if err != nil {
+		return err
+	}
+
+	if check != nil {
+		if err := check(exists, strconv.FormatInt(version, 10)); err != nil {
+			return err
+		}
+	}
+
+	// Files are always written to the layout of storeDepth and removed from
+	// the layout they were found in
+	if err := os.MkdirAll(storeDir, os.ModePerm); err != nil {
+		return fmt.Errorf("Unable to create directory %s: %s", storeDir, err.Error())
+	}
+
+	data, err := encodeObject(file.codec(), file.Compression, object)
+	if err != nil {
+		return err
+	}
+
+	if err := file.writeKeyFile(key, path.Join(storeDir, encodeFileKey(key)), data); err != nil {
 		return fmt.Errorf("Unable to store file: %s", err.Error())
 	}
 
+	versionData := []byte(strconv.FormatInt(version+1, 10))
+	if err := file.writeKeyFile(key, versionPath(storeDir, key), versionData); err != nil {
+		return fmt.Errorf("Unable to store version file: %s", err.Error())
+	}
+
+	if dir != storeDir {
+		os.Remove(path.Join(dir, encodeFileKey(key)))
+		os.Remove(versionPath(dir, key))
+	}
+
 	return nil
 }
 
+// writeKeyFile writes a file of the key atomically through the temp file of
+// its lock stripe, see tempPath. Must be called while holding the exclusive
+// key lock.
+func (file *FileStore) writeKeyFile(key string, filePath string, data []byte) error {
+	tempPath := file.tempPath(keyStripe(key))
+	if err := os.MkdirAll(path.Dir(tempPath), os.ModePerm); err != nil {
+		return fmt.Errorf("Unable to create directory %s: %s", path.Dir(tempPath), err.Error())
+	}
+
+	if err := os.Remove(tempPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Unable to remove temp file %s: %s", tempPath, err.Error())
+	}
+
+	temp, err := os.OpenFile(tempPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return fmt.Errorf("Unable to create temp file for %s: %s", filePath, err.Error())
+	}
+
+	return replaceFile(temp, filePath, data, file.SyncDir)
+}
+
+func (file *FileStore) codec() Codec {
+	if file.Codec == nil {
+		return JSONCodec{}
+	}
+	return file.Codec
+}
+
+// Versions are kept in a hidden file next to the key file, which is left
+// behind on Delete so versions keep increasing if the key is stored again.
+func versionPath(dir string, key string) string {
+	return path.Join(dir, "."+encodeFileKey(key)+".version")
+}
+
+// readVersion returns the version of the key in the folder, which is 0 for
+// files stored before versions were tracked. Must be called while holding
+// the lock.
+func (file *FileStore) readVersion(dir string, key string) (int64, error) {
+	b, err := ioutil.ReadFile(versionPath(dir, key))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("Unable to read version file: %s", err.Error())
+	}
+
+	version, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to parse version file: %s", err.Error())
+	}
+
+	return version, nil
+}
+
+func fileExists(filePath string) (bool, error) {
+	if _, err := os.Stat(filePath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("Unable to stat file: %s", err.Error())
+	}
+
+	return true, nil
+}
+
 func (file *FileStore) Load(key string, object interface{}) error {
-	file.mutex.Lock()
-	defer file.mutex.Unlock()
+	return file.LoadContext(context.Background(), key, object)
+}
+
+func (file *FileStore) LoadContext(ctx context.Context, key string, object interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	if object == nil || reflect.ValueOf(object).IsNil() {
-		return errors.New("Unable to load file to nil struct")
+	if err := validateFileKey(key); err != nil {
+		return err
 	}
 
-	filePath := path.Join(file.Path, key)
-	if err := LoadFileToObject(filePath, object); err != nil {
+	if err := validateObject(object); err != nil {
 		return err
 	}
 
-	return nil
+	unlock, err := file.lockKey(key, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	filePath, err := file.existingKeyPath(key)
+	if err != nil {
+		return err
+	}
+
+	return loadFileToObject(filePath, object, file.codec(), file.Compression)
 }
 
 func (file *FileStore) LoadAll(f func() interface{}) (interface{}, error) {
-	file.mutex.Lock()
-	defer file.mutex.Unlock()
+	return file.LoadAllContext(context.Background(), f)
+}
 
-	items := []interface{}{}
-	files, filesErr := ioutil.ReadDir(file.Path)
-	if filesErr != nil {
-		return nil, fmt.Errorf("Unable to read directory %s: %s", file.Path, filesErr.Error())
+func (file *FileStore) LoadAllContext(ctx context.Context, f func() interface{}) (interface{}, error) {
+	_, items, _, err := file.loadPage(ctx, f, "", 0)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, fileInfo := range files {
-		if fileInfo.IsDir() {
-			continue
+	return items, nil
+}
+
+func (file *FileStore) LoadPage(f func() interface{}, cursor string, limit int) (interface{}, string, error) {
+	return file.LoadPageContext(context.Background(), f, cursor, limit)
+}
+
+func (file *FileStore) LoadPageContext(ctx context.Context, f func() interface{}, cursor string, limit int) (interface{}, string, error) {
+	_, items, next, err := file.loadPage(ctx, f, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return items, next, nil
+}
+
+// Iterate reads and sorts the keys once, and loads their files a page at a
+// time, so the folder isn't read again for every page. Keys deleted during
+// the iteration are skipped.
+func (file *FileStore) Iterate(f func() interface{}, fn func(key string, object interface{}) error) error {
+	keys, err := file.sortedKeys(context.Background())
+	if err != nil {
+		return err
+	}
+
+	loadPage := func(ctx context.Context, f func() interface{}, cursor string, limit int) ([]string, []interface{}, string, error) {
+		start := sort.SearchStrings(keys, cursor)
+		if start < len(keys) && cursor != "" && keys[start] == cursor {
+			start++
+		}
+
+		page, next := keys[start:], ""
+		if len(page) > limit {
+			page = page[:limit]
+			next = page[len(page)-1]
+		}
+
+		page, items, err := file.loadKeys(ctx, f, page)
+		return page, items, next, err
+	}
+
+	return iteratePages(context.Background(), loadPage, f, fn)
+}
+
+// loadPage loads up to limit files in key order after the cursor, which is
+// the last key of the previous page, and returns their keys and objects.
+func (file *FileStore) loadPage(ctx context.Context, f func() interface{}, cursor string, limit int) ([]string, []interface{}, string, error) {
+	keys, err := file.sortedKeys(ctx)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	keys, next := pageKeys(keys, "", cursor, limit)
+
+	keys, items, err := file.loadKeys(ctx, f, keys)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	return keys, items, next, nil
+}
+
+// sortedKeys returns the keys of every file in key order.
+func (file *FileStore) sortedKeys(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock, err := file.lockStore(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	keys, err := file.readKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// loadKeys loads the files of the keys, skipping the keys deleted since they
+// were read, and returns the loaded keys and objects.
+func (file *FileStore) loadKeys(ctx context.Context, f func() interface{}, keys []string) ([]string, []interface{}, error) {
+	unlock, err := file.lockStore(false)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	loaded := []string{}
+	items := []interface{}{}
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
 		}
 		v := f()
-		filePath := path.Join(file.Path, fileInfo.Name())
-		if err := LoadFileToObject(filePath, v); err != nil {
-			return nil, fmt.Errorf("Unable to load file %s: %s", filePath, err.Error())
+		if err := file.loadKeyFile(key, v); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return nil, nil, err
 		}
+		loaded = append(loaded, key)
 		items = append(items, v)
 	}
 
-	return items, nil
+	return loaded, items, nil
 }
 
 func (file *FileStore) Delete(key string) error {
-	file.mutex.Lock()
-	defer file.mutex.Unlock()
+	return file.DeleteContext(context.Background(), key)
+}
+
+func (file *FileStore) DeleteContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := validateFileKey(key); err != nil {
+		return err
+	}
+
+	unlock, err := file.lockKey(key, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	dir, storeDir, exists, err := file.locateKey(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("Unable to find %s file: %w", key, ErrNotFound)
+	}
+
+	if err := os.Remove(path.Join(dir, encodeFileKey(key))); err != nil {
+		return fmt.Errorf("Unable to delete file: %s", err.Error())
+	}
+
+	// Keeps the version in the layout the key is stored to next
+	if dir != storeDir {
+		if err := os.MkdirAll(storeDir, os.ModePerm); err == nil {
+			os.Rename(versionPath(dir, key), versionPath(storeDir, key))
+		}
+	}
+
+	return nil
+}
+
+func (file *FileStore) ListKeys(prefix string) ([]string, error) {
+	keys, _, err := file.ListKeysPage(prefix, "", 0)
+	return keys, err
+}
+
+func (file *FileStore) ListKeysPage(prefix string, cursor string, limit int) ([]string, string, error) {
+	return file.ListKeysPageContext(context.Background(), prefix, cursor, limit)
+}
+
+func (file *FileStore) ListKeysPageContext(ctx context.Context, prefix string, cursor string, limit int) ([]string, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	unlock, err := file.lockStore(false)
+	if err != nil {
+		return nil, "", err
+	}
+	defer unlock()
+
+	keys, err := file.readKeys()
+	if err != nil {
+		return nil, "", err
+	}
+
+	keys, next := pageKeys(keys, prefix, cursor, limit)
+	return keys, next, nil
+}
+
+// loadKeyFile loads the file of a key listed by readKeys, while holding
+// the shared store lock.
+func (file *FileStore) loadKeyFile(key string, object interface{}) error {
+	unlock, err := file.lockKeyFile(key, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	filePath, err := file.existingKeyPath(key)
+	if err != nil {
+		return err
+	}
+
+	if err := loadFileToObject(filePath, object, file.codec(), file.Compression); err != nil {
+		return fmt.Errorf("Unable to load file %s: %s", filePath, err.Error())
+	}
+
+	return nil
+}
+
+func (file *FileStore) Stat(key string) (*ObjectInfo, error) {
+	return file.StatContext(context.Background(), key)
+}
+
+func (file *FileStore) StatContext(ctx context.Context, key string) (*ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := validateFileKey(key); err != nil {
+		return nil, err
+	}
+
+	unlock, err := file.lockKey(key, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	dir, exists, err := file.findKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return &ObjectInfo{Key: key}, nil
+	}
+
+	fileInfo, err := os.Stat(path.Join(dir, encodeFileKey(key)))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to stat file: %s", err.Error())
+	}
+
+	version, err := file.readVersion(dir, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ObjectInfo{
+		Key:     key,
+		Exists:  true,
+		Size:    fileInfo.Size(),
+		ModTime: fileInfo.ModTime(),
+		Version: strconv.FormatInt(version, 10),
+	}, nil
+}
+
+func (file *FileStore) StoreMulti(keys []string, objects []interface{}) error {
+	return file.StoreMultiContext(context.Background(), keys, objects)
+}
+
+func (file *FileStore) StoreMultiContext(ctx context.Context, keys []string, objects []interface{}) error {
+	if err := validateMulti(keys, objects); err != nil {
+		return err
+	}
+
+	errs := make([]error, len(keys))
+	for _, i := range uniqueIndexes(keys, errs) {
+		errs[i] = file.StoreContext(ctx, keys[i], objects[i])
+	}
+
+	return multiError(errs)
+}
+
+func (file *FileStore) LoadMulti(keys []string, objects []interface{}) error {
+	return file.LoadMultiContext(context.Background(), keys, objects)
+}
+
+func (file *FileStore) LoadMultiContext(ctx context.Context, keys []string, objects []interface{}) error {
+	if err := validateMulti(keys, objects); err != nil {
+		return err
+	}
+
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		errs[i] = file.LoadContext(ctx, key, objects[i])
+	}
+
+	return multiError(errs)
+}
+
+func (file *FileStore) DeleteMulti(keys []string) error {
+	return file.DeleteMultiContext(context.Background(), keys)
+}
+
+func (file *FileStore) DeleteMultiContext(ctx context.Context, keys []string) error {
+	errs := make([]error, len(keys))
+	for _, i := range uniqueIndexes(keys, errs) {
+		errs[i] = file.DeleteContext(ctx, keys[i])
+	}
 
-	return os.Remove(path.Join(file.Path, key))
+	return multiError(errs)
 }
@@ -1,7 +1,14 @@
 package blobstore
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -38,3 +45,491 @@ func TestStoreLoad(t *testing.T) {
 	err = store.Load("key1", newData)
 	assert.Nil(t, err, "Load error should be nil")
 }
+
+func TestStoreCancelledContext(t *testing.T) {
+	store, err := NewFileStore("testStore")
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	data := &struct {
+		Data string
+	}{Data: "testing"}
+	err = store.StoreContext(ctx, "key1", data)
+	assert.Equal(t, context.Canceled, err, "Store should fail with cancelled context")
+
+	err = store.Load("key1", data)
+	assert.NotNil(t, err, "Cancelled store should not have written key1")
+}
+
+func TestLoadMissingKey(t *testing.T) {
+	store, err := NewFileStore("testStore")
+	if err != nil {
+		panic(err)
+	}
+
+	data := &struct {
+		Data string
+	}{}
+	err = store.Load("missing", data)
+	assert.True(t, errors.Is(err, ErrNotFound), "Load error should be ErrNotFound")
+
+	err = store.Delete("missing")
+	assert.True(t, errors.Is(err, ErrNotFound), "Delete error should be ErrNotFound")
+
+	err = store.Store("", data)
+	assert.True(t, errors.Is(err, ErrInvalidKey), "Store error should be ErrInvalidKey")
+}
+
+func TestPathTraversalKeys(t *testing.T) {
+	store, err := NewFileStore("testStore")
+	if err != nil {
+		panic(err)
+	}
+
+	keys := []string{"../../etc/passwd", "nested/key", ".hidden", "..", "."}
+	for _, key := range keys {
+		data := &struct {
+			Data string
+		}{Data: key}
+		err = store.Store(key, data)
+		assert.Nil(t, err, "Store error should be nil")
+	}
+
+	// Every key is stored as a file directly in the store folder, next to
+	// the hidden folders of the store
+	files, err := ioutil.ReadDir(store.Path)
+	assert.Nil(t, err, "ReadDir error should be nil")
+	for _, fileInfo := range files {
+		assert.False(t, fileInfo.IsDir() && !strings.HasPrefix(fileInfo.Name(), "."), "Keys should not create folders")
+	}
+
+	listed, err := store.ListKeys("")
+	assert.Nil(t, err, "ListKeys error should be nil")
+	assert.ElementsMatch(t, keys, listed)
+}
+
+func TestMigrateLegacyFiles(t *testing.T) {
+	storeDir, err := ioutil.TempDir("/tmp", "filestoretest")
+	if err != nil {
+		panic(err)
+	}
+
+	legacy := map[string]string{
+		"plain":     `{"Data":"plain"}`,
+		"with a":    `{"Data":"with a"}`,
+		"with%20a":  `{"Data":"with%20a"}`,
+		"nested/id": `{"Data":"nested/id"}`,
+	}
+	os.MkdirAll(path.Join(storeDir, "nested"), os.ModePerm)
+	for key, value := range legacy {
+		ioutil.WriteFile(path.Join(storeDir, key), []byte(value), 0666)
+	}
+	ioutil.WriteFile(path.Join(storeDir, ".plain.version"), []byte("3"), 0666)
+
+	store := &FileStore{
+		Name: "testStore",
+		Path: storeDir,
+	}
+	assert.Nil(t, store.Migrate(), "Migrate error should be nil")
+	// Migrating again should not touch the migrated files
+	assert.Nil(t, store.Migrate(), "Second migrate error should be nil")
+
+	for key := range legacy {
+		data := &struct {
+			Data string
+		}{}
+		assert.Nil(t, store.Load(key, data), "Load error should be nil")
+		assert.Equal(t, key, data.Data)
+	}
+
+	info, err := store.Stat("plain")
+	assert.Nil(t, err, "Stat error should be nil")
+	assert.Equal(t, "3", info.Version)
+}
+
+func TestOverwriteShorterValue(t *testing.T) {
+	store, err := NewFileStore("testStore")
+	if err != nil {
+		panic(err)
+	}
+	store.SyncDir = true
+
+	err = store.Store("key1", &struct {
+		Data string
+	}{Data: "a much longer value than the next one"})
+	assert.Nil(t, err, "Store error should be nil")
+
+	err = store.Store("key1", &struct {
+		Data string
+	}{Data: "short"})
+	assert.Nil(t, err, "Store error should be nil")
+
+	newData := &struct {
+		Data string
+	}{}
+	err = store.Load("key1", newData)
+	assert.Nil(t, err, "Load error should be nil")
+	assert.Equal(t, "short", newData.Data)
+
+	// No temp files are left behind
+	files, err := ioutil.ReadDir(store.Path)
+	assert.Nil(t, err, "ReadDir error should be nil")
+	for _, fileInfo := range files {
+		assert.False(t, strings.HasPrefix(fileInfo.Name(), ".tmp-"), "Temp file should be renamed")
+	}
+}
+
+func TestRemoveStaleTempFiles(t *testing.T) {
+	store, err := NewFileStore("testStore")
+	if err != nil {
+		panic(err)
+	}
+
+	// A temp file left by an interrupted write is replaced by the next
+	// write of its stripe
+	tempPath := store.tempPath(keyStripe("key1"))
+	assert.Nil(t, os.MkdirAll(path.Dir(tempPath), os.ModePerm))
+	assert.Nil(t, ioutil.WriteFile(tempPath, []byte("{"), 0666))
+	assert.Nil(t, store.Store("key1", &TestDeployment{Name: "key1"}), "Store error should be nil")
+	_, err = os.Stat(tempPath)
+	assert.True(t, os.IsNotExist(err), "Temp file %s should be renamed", tempPath)
+
+	// Temp files of previous versions are removed by Rebalance
+	shardDir := store.keyDir("key1", 2)
+	assert.Nil(t, os.MkdirAll(shardDir, os.ModePerm))
+	tempPaths := []string{path.Join(store.Path, ".tmp-1234"), path.Join(shardDir, ".tmp-5678")}
+	for _, tempPath := range tempPaths {
+		assert.Nil(t, ioutil.WriteFile(tempPath, []byte("{"), 0666))
+	}
+
+	assert.Nil(t, store.Rebalance(), "Rebalance error should be nil")
+	for _, tempPath := range tempPaths {
+		_, err := os.Stat(tempPath)
+		assert.True(t, os.IsNotExist(err), "Temp file %s should be removed", tempPath)
+	}
+}
+
+func TestWriteObjectToFileMode(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "filestoretest")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Files are written with the mode of os.Create, 0666 before the umask
+	created, err := os.Create(path.Join(dir, "created"))
+	assert.Nil(t, err)
+	created.Close()
+	assert.Nil(t, WriteObjectToFile(path.Join(dir, "written"), &struct{ Data string }{Data: "data"}))
+
+	createdInfo, err := os.Stat(path.Join(dir, "created"))
+	assert.Nil(t, err)
+	writtenInfo, err := os.Stat(path.Join(dir, "written"))
+	assert.Nil(t, err)
+	assert.Equal(t, createdInfo.Mode(), writtenInfo.Mode())
+}
+
+func TestLockFilesAreBounded(t *testing.T) {
+	store, err := NewFileStore("testStore")
+	if err != nil {
+		panic(err)
+	}
+
+	for i := 0; i < 2*fileLockStripes; i++ {
+		key := fmt.Sprintf("missing%d", i)
+		_, err := store.Stat(key)
+		assert.Nil(t, err, "Stat error should be nil")
+		err = store.Load(key, &struct{ Data string }{})
+		assert.True(t, errors.Is(err, ErrNotFound), "Load error should be ErrNotFound, got %v", err)
+	}
+
+	files, err := ioutil.ReadDir(path.Join(store.Path, fileLocksDir))
+	assert.Nil(t, err, "ReadDir error should be nil")
+	assert.True(t, len(files) <= fileLockStripes, "Lock files should be bounded by the stripes, got %d", len(files))
+}
+
+func TestSharedFolderLocking(t *testing.T) {
+	store, err := NewFileStore("testStore")
+	if err != nil {
+		panic(err)
+	}
+	// A second store on the same folder, like another process would open
+	other := &FileStore{
+		Name: store.Name,
+		Path: store.Path,
+	}
+
+	type counter struct {
+		Count int
+	}
+	assert.Nil(t, store.Create("counter", &counter{}), "Create error should be nil")
+
+	// Increments with compare and swap, so lost updates would show up
+	// as a wrong count
+	increment := func(s *FileStore) {
+		for {
+			info, err := s.Stat("counter")
+			assert.Nil(t, err, "Stat error should be nil")
+			c := &counter{}
+			assert.Nil(t, s.Load("counter", c), "Load error should be nil")
+			c.Count++
+			err = s.StoreIfVersion("counter", c, info.Version)
+			if !errors.Is(err, ErrConflict) {
+				assert.Nil(t, err, "StoreIfVersion error should be nil")
+				return
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			increment(store)
+		}()
+		go func() {
+			defer wg.Done()
+			increment(other)
+		}()
+	}
+	wg.Wait()
+
+	c := &counter{}
+	assert.Nil(t, store.Load("counter", c), "Load error should be nil")
+	assert.Equal(t, 40, c.Count)
+}
+
+// BenchmarkParallelLoad runs readers alongside writers, one store of every
+// four operations, against the file store and against the same store
+// serialized by a single mutex, like the file store used to be.
+func BenchmarkParallelLoad(b *testing.B) {
+	store, err := NewFileStore("testStore")
+	if err != nil {
+		panic(err)
+	}
+
+	keys := make([]string, 64)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+		data := &struct {
+			Data string
+		}{Data: strings.Repeat("testing", 100)}
+		if err := store.Store(keys[i], data); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	run := func(b *testing.B, s BlobStore) {
+		b.RunParallel(func(pb *testing.PB) {
+			data := &struct {
+				Data string
+			}{}
+			for i := 0; pb.Next(); i++ {
+				key := keys[i%len(keys)]
+				var err error
+				if i%4 == 0 {
+					data.Data = strings.Repeat("testing", 100)
+					err = s.Store(key, data)
+				} else {
+					err = s.Load(key, data)
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+	b.Run("Serialized", func(b *testing.B) {
+		run(b, &serializedStore{BlobStore: store})
+	})
+
+	b.Run("Parallel", func(b *testing.B) {
+		run(b, store)
+	})
+}
+
+// serializedStore runs one operation of the store at a time.
+type serializedStore struct {
+	BlobStore
+	mutex sync.Mutex
+}
+
+func (s *serializedStore) Store(key string, object interface{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.BlobStore.Store(key, object)
+}
+
+func (s *serializedStore) Load(key string, object interface{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.BlobStore.Load(key, object)
+}
+
+func TestShardedLayout(t *testing.T) {
+	store, err := NewFileStore("testStore")
+	if err != nil {
+		panic(err)
+	}
+
+	// Keys stored in the flat layout are still read once sharded
+	keys := []string{"key1", "key2", "key3"}
+	for _, key := range keys {
+		err = store.Store(key, &struct {
+			Data string
+		}{Data: key})
+		assert.Nil(t, err, "Store error should be nil")
+	}
+
+	store.ShardDepth = 2
+	assert.Nil(t, store.Store("key4", &struct {
+		Data string
+	}{Data: "key4"}), "Store error should be nil")
+	keys = append(keys, "key4")
+	_, err = os.Stat(path.Join(store.Path, fileShardsDir, shardNames("key4", 2)[0], shardNames("key4", 2)[1], "key4"))
+	assert.Nil(t, err, "Key file should be in its shard folder")
+
+	// Storing a flat key again moves it to its shard
+	info, err := store.Stat("key1")
+	assert.Nil(t, err, "Stat error should be nil")
+	assert.Nil(t, store.StoreIfVersion("key1", &struct {
+		Data string
+	}{Data: "key1"}, info.Version), "StoreIfVersion error should be nil")
+	_, err = os.Stat(path.Join(store.Path, "key1"))
+	assert.True(t, errors.Is(err, os.ErrNotExist), "Flat file should be removed")
+
+	assert.Nil(t, store.Rebalance(), "Rebalance error should be nil")
+	for _, key := range keys {
+		dir, exists, err := store.findKey(key)
+		assert.Nil(t, err, "findKey error should be nil")
+		assert.True(t, exists)
+		assert.Equal(t, store.keyDir(key, 2), dir)
+	}
+
+	listed, err := store.ListKeys("")
+	assert.Nil(t, err, "ListKeys error should be nil")
+	assert.Equal(t, keys, listed)
+
+	items, err := store.LoadAll(func() interface{} {
+		return &struct {
+			Data string
+		}{}
+	})
+	assert.Nil(t, err, "LoadAll error should be nil")
+	assert.Equal(t, 4, len(items.([]interface{})))
+
+	// Back to the flat layout, keeping the versions
+	store.ShardDepth = 0
+	assert.Nil(t, store.Rebalance(), "Rebalance error should be nil")
+	_, err = os.Stat(path.Join(store.Path, fileShardsDir))
+	assert.True(t, errors.Is(err, os.ErrNotExist), "Shard folders should be removed")
+
+	newInfo, err := store.Stat("key1")
+	assert.Nil(t, err, "Stat error should be nil")
+	assert.Equal(t, "2", newInfo.Version)
+}
+
+func TestRebalanceMarker(t *testing.T) {
+	store, err := NewFileStore("testStore")
+	if err != nil {
+		panic(err)
+	}
+
+	store.ShardDepth = 1
+	assert.Nil(t, store.Store("key1", &struct {
+		Data string
+	}{Data: "key1"}), "Store error should be nil")
+
+	// Other depths than the current and flat ones are only looked in while
+	// the rebalance marker exists
+	store.ShardDepth = 2
+	_, exists, err := store.findKey("key1")
+	assert.Nil(t, err, "findKey error should be nil")
+	assert.False(t, exists)
+
+	assert.Nil(t, store.checkShardDepth(), "checkShardDepth error should be nil")
+	dir, exists, err := store.findKey("key1")
+	assert.Nil(t, err, "findKey error should be nil")
+	assert.True(t, exists)
+	assert.Equal(t, store.keyDir("key1", 1), dir)
+
+	assert.Nil(t, store.Rebalance(), "Rebalance error should be nil")
+	_, err = os.Stat(path.Join(store.Path, fileRebalanceMarker))
+	assert.True(t, errors.Is(err, os.ErrNotExist), "Rebalance marker should be removed")
+	dir, exists, err = store.findKey("key1")
+	assert.Nil(t, err, "findKey error should be nil")
+	assert.True(t, exists)
+	assert.Equal(t, store.keyDir("key1", 2), dir)
+
+	// The recorded depth matches, no marker is needed
+	assert.Nil(t, store.checkShardDepth(), "checkShardDepth error should be nil")
+	_, err = os.Stat(path.Join(store.Path, fileRebalanceMarker))
+	assert.True(t, errors.Is(err, os.ErrNotExist), "Rebalance marker should not be written")
+}
+
+func TestRebalanceWithOpenStore(t *testing.T) {
+	opened, err := NewFileStore("testStore")
+	if err != nil {
+		panic(err)
+	}
+	assert.Nil(t, opened.Store("key1", &TestDeployment{Name: "key1"}), "Store error should be nil")
+
+	// Rebalanced by another process while the store is open with depth 0
+	rebalanced := &FileStore{Name: opened.Name, Path: opened.Path, ShardDepth: 2}
+	assert.Nil(t, rebalanced.checkShardDepth(), "checkShardDepth error should be nil")
+	assert.Nil(t, rebalanced.Rebalance(), "Rebalance error should be nil")
+
+	loaded := &TestDeployment{}
+	assert.Nil(t, opened.Load("key1", loaded), "Load error should be nil")
+	assert.Equal(t, "key1", loaded.Name)
+
+	// Writes go to the rebalanced layout instead of the flat one
+	assert.Nil(t, opened.Store("key1", &TestDeployment{Name: "stored"}), "Store error should be nil")
+	assert.Nil(t, opened.Store("key2", &TestDeployment{Name: "key2"}), "Store error should be nil")
+	for _, key := range []string{"key1", "key2"} {
+		dir, exists, err := rebalanced.findKey(key)
+		assert.Nil(t, err, "findKey error should be nil")
+		assert.True(t, exists)
+		assert.Equal(t, rebalanced.keyDir(key, 2), dir)
+	}
+	loaded = &TestDeployment{}
+	assert.Nil(t, rebalanced.Load("key1", loaded), "Load error should be nil")
+	assert.Equal(t, "stored", loaded.Name)
+
+	assert.Nil(t, opened.Delete("key2"), "Delete error should be nil")
+	err = rebalanced.Load("key2", &TestDeployment{})
+	assert.True(t, errors.Is(err, ErrNotFound), "Load should be ErrNotFound, got %v", err)
+}
+
+func TestIterateSkipsDeletedKeys(t *testing.T) {
+	store, err := NewFileStore("testStore")
+	if err != nil {
+		panic(err)
+	}
+
+	for i := 0; i < 250; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		assert.Nil(t, store.Store(key, &TestDeployment{Name: key}), "Store error should be nil")
+	}
+
+	// Pages are loaded from the keys read when the iteration started
+	visited := []string{}
+	err = store.Iterate(func() interface{} { return &TestDeployment{} }, func(key string, object interface{}) error {
+		if key == "key000" {
+			assert.Nil(t, store.Delete("key150"))
+		}
+		assert.Equal(t, key, object.(*TestDeployment).Name)
+		visited = append(visited, key)
+		return nil
+	})
+	assert.Nil(t, err, "Iterate error should be nil")
+	assert.Len(t, visited, 249)
+	assert.NotContains(t, visited, "key150")
+	assert.Equal(t, "key249", visited[len(visited)-1])
+}
@@ -0,0 +1,212 @@
+package blobstore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// File marking a file store folder whose file names are encoded keys
+	fileLayoutMarker = ".layout"
+	// Folder holding the files being migrated to encoded file names
+	fileMigrateDir = ".migrate"
+	// File locked by every process using the store folder
+	fileStoreLock = ".lock"
+)
+
+// encodeFileKey maps a key to a file name by percent encoding every byte
+// other than letters, digits, '-', '_' and '.', and a leading '.', so keys
+// can't escape the store folder or collide with hidden files.
+func encodeFileKey(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if isFileNameByte(c) && !(i == 0 && c == '.') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+// decodeFileKey returns the key of a file name created by encodeFileKey.
+func decodeFileKey(name string) (string, error) {
+	key, err := url.PathUnescape(name)
+	if err != nil || key == "" || encodeFileKey(key) != name {
+		return "", fmt.Errorf("File name %s is not an encoded key", name)
+	}
+
+	return key, nil
+}
+
+func isFileNameByte(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+		c == '-' || c == '_' || c == '.'
+}
+
+// validateFileKey checks the encoded key can be used as a file name.
+func validateFileKey(key string) error {
+	if err := validateKey(key, 0); err != nil {
+		return err
+	}
+
+	// File names can not be greater than 255 bytes, including the
+	// dot and .version suffix of the version file
+	if len(encodeFileKey(key)) > 246 {
+		return fmt.Errorf("Encoded key can't be longer than 246 bytes: %w", ErrInvalidKey)
+	}
+
+	return nil
+}
+
+// Migrate renames the files of a store created before keys were encoded,
+// whose file names are the raw keys, to their encoded file names. Stores
+// that are already migrated are left untouched, without waiting for the
+// exclusive store lock.
+func (file *FileStore) Migrate() error {
+	markerPath := path.Join(file.Path, fileLayoutMarker)
+	migratePath := path.Join(file.Path, fileMigrateDir)
+	if migrated, err := isMigrated(markerPath, migratePath); err != nil || migrated {
+		return err
+	}
+
+	unlock, err := file.lockStore(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := os.Stat(markerPath); errors.Is(err, os.ErrNotExist) {
+		// Move the files aside first, so renamed files can't overwrite
+		// files that are not renamed yet.
+		if err := file.moveLegacyFiles(migratePath); err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(markerPath, []byte("encoded\n"), 0666); err != nil {
+			return fmt.Errorf("Unable to write layout marker: %s", err.Error())
+		}
+	} else if err != nil {
+		return fmt.Errorf("Unable to stat layout marker: %s", err.Error())
+	}
+
+	files, err := ioutil.ReadDir(migratePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Unable to read directory %s: %s", migratePath, err.Error())
+	}
+
+	for _, fileInfo := range files {
+		if err := os.Rename(path.Join(migratePath, fileInfo.Name()), path.Join(file.Path, fileInfo.Name())); err != nil {
+			return fmt.Errorf("Unable to move migrated file %s: %s", fileInfo.Name(), err.Error())
+		}
+	}
+
+	return os.Remove(migratePath)
+}
+
+// isMigrated checks the layout marker exists and no migration was left
+// unfinished.
+func isMigrated(markerPath string, migratePath string) (bool, error) {
+	marked, err := fileExists(markerPath)
+	if err != nil || !marked {
+		return false, err
+	}
+
+	unfinished, err := fileExists(migratePath)
+	return !unfinished, err
+}
+
+// moveLegacyFiles moves every file named after its raw key, including files
+// nested in folders by keys with slashes, to the migrate folder under its
+// encoded file name.
+func (file *FileStore) moveLegacyFiles(migratePath string) error {
+	if err := os.MkdirAll(migratePath, os.ModePerm); err != nil {
+		return fmt.Errorf("Unable to create directory %s: %s", migratePath, err.Error())
+	}
+
+	dirs := []string{}
+	err := filepath.Walk(file.Path, func(filePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if filePath == file.Path {
+			return nil
+		}
+
+		if fileInfo.IsDir() {
+			if filePath == migratePath {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, filePath)
+			return nil
+		}
+
+		key, err := filepath.Rel(file.Path, filePath)
+		if err != nil {
+			return err
+		}
+		key = filepath.ToSlash(key)
+		if key == fileLayoutMarker || key == fileStoreLock {
+			return nil
+		}
+		if strings.HasPrefix(path.Base(key), tempFilePrefix) {
+			// Left by a write interrupted before its rename
+			return os.Remove(filePath)
+		}
+
+		name := encodeFileKey(key)
+		if dir, base := path.Split(key); strings.HasPrefix(base, ".") && strings.HasSuffix(base, ".version") {
+			// Version files are named after the key of the file they belong to
+			name = "." + encodeFileKey(dir+strings.TrimSuffix(strings.TrimPrefix(base, "."), ".version")) + ".version"
+		}
+
+		return os.Rename(filePath, path.Join(migratePath, name))
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to move legacy files: %s", err.Error())
+	}
+
+	// Remove the emptied folders, deepest first
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		os.Remove(dir)
+	}
+
+	return nil
+}
+
+// removeTempFiles removes the temp files left next to the key files by
+// interrupted writes of previous versions, which wrote them there instead
+// of in the stripe temp files. Must be called while holding the exclusive
+// store lock, so no write is in progress.
+func (file *FileStore) removeTempFiles() error {
+	err := filepath.Walk(file.Path, func(filePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !fileInfo.IsDir() && strings.HasPrefix(fileInfo.Name(), tempFilePrefix) {
+			if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to remove temp files: %s", err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package blobstore
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+const (
+	// Number of key locks, keys are spread over them by hash
+	fileLockStripes = 64
+	// Folder holding the lock files of the key lock stripes
+	fileLocksDir = ".locks"
+	// Folder holding the temp files of the key lock stripes
+	fileTempDir = ".tmp"
+)
+
+// keyStripe returns the lock stripe of the key.
+func keyStripe(key string) uint32 {
+	return keyHash(key) % fileLockStripes
+}
+
+// lockPath is the lock file of the stripe, which every process maps keys to
+// the same way, so the number of lock files stays fixed however many keys
+// are used. Lock files are kept out of the key folders.
+func (file *FileStore) lockPath(stripe uint32) string {
+	return path.Join(file.Path, fileLocksDir, fmt.Sprintf("%02d", stripe))
+}
+
+// tempPath is the temp file the key files of the stripe are written to
+// before being renamed into place. Only the writer holding the exclusive
+// stripe lock uses it, so a temp file left by an interrupted write is
+// replaced by the next write of the stripe instead of piling up.
+func (file *FileStore) tempPath(stripe uint32) string {
+	return path.Join(file.Path, fileTempDir, fmt.Sprintf("%02d", stripe))
+}
+
+// lockStore takes the lock of the whole store folder, shared by all the
+// operations on keys and exclusive when changing the folder layout.
+// The returned func releases the lock.
+func (file *FileStore) lockStore(exclusive bool) (func(), error) {
+	unlockMutex := file.mutex.RUnlock
+	if exclusive {
+		file.mutex.Lock()
+		unlockMutex = file.mutex.Unlock
+	} else {
+		file.mutex.RLock()
+	}
+
+	lock, err := lockFile(path.Join(file.Path, fileStoreLock), exclusive)
+	if err != nil {
+		unlockMutex()
+		return nil, err
+	}
+
+	return func() {
+		lock.Unlock()
+		unlockMutex()
+	}, nil
+}
+
+// lockKey takes the shared store lock and the lock of the key, exclusive
+// when changing the key. The returned func releases both locks.
+func (file *FileStore) lockKey(key string, exclusive bool) (func(), error) {
+	unlockStore, err := file.lockStore(false)
+	if err != nil {
+		return nil, err
+	}
+
+	unlockKey, err := file.lockKeyFile(key, exclusive)
+	if err != nil {
+		unlockStore()
+		return nil, err
+	}
+
+	return func() {
+		unlockKey()
+		unlockStore()
+	}, nil
+}
+
+// lockKeyFile takes the in process and flock locks of the stripe of the
+// key, the caller must already hold the store lock.
+func (file *FileStore) lockKeyFile(key string, exclusive bool) (func(), error) {
+	index := keyStripe(key)
+	stripe := &file.stripes[index]
+
+	unlockStripe := stripe.RUnlock
+	if exclusive {
+		stripe.Lock()
+		unlockStripe = stripe.Unlock
+	} else {
+		stripe.RLock()
+	}
+
+	lockPath := file.lockPath(index)
+	if err := os.MkdirAll(path.Dir(lockPath), os.ModePerm); err != nil {
+		unlockStripe()
+		return nil, fmt.Errorf("Unable to create directory %s: %s", path.Dir(lockPath), err.Error())
+	}
+
+	lock, err := lockFile(lockPath, exclusive)
+	if err != nil {
+		unlockStripe()
+		return nil, err
+	}
+
+	return func() {
+		lock.Unlock()
+		unlockStripe()
+	}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package blobstore
+
+// fileLock is a no-op on platforms without flock, where file stores are
+// only safe to use from a single process.
+type fileLock struct{}
+
+func lockFile(path string, exclusive bool) (*fileLock, error) {
+	return &fileLock{}, nil
+}
+
+func (lock *fileLock) Unlock() {}
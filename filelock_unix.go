@@ -0,0 +1,49 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package blobstore
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fileLock is an advisory flock on a lock file, which is shared between
+// all the processes using the same store folder.
+type fileLock struct {
+	file *os.File
+}
+
+// lockFile blocks until it holds the lock on the lock file at path, which
+// is created if needed. Exclusive locks exclude every other lock, shared
+// locks only exclude exclusive ones.
+func lockFile(path string, exclusive bool) (*fileLock, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open lock file %s: %s", path, err.Error())
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	for {
+		err = syscall.Flock(int(file.Fd()), how)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Unable to lock file %s: %s", path, err.Error())
+	}
+
+	return &fileLock{file: file}, nil
+}
+
+// Unlock releases the lock, closing the lock file releases it as well.
+func (lock *fileLock) Unlock() {
+	syscall.Flock(int(lock.file.Fd()), syscall.LOCK_UN)
+	lock.file.Close()
+}
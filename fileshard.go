@@ -0,0 +1,396 @@
+package blobstore
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Folder holding the shard folders of the keys
+	fileShardsDir = ".shards"
+	// Each shard level uses one byte of the 32 bit key hash
+	fileMaxShardDepth = 4
+	// File holding the shard depth of the folder layout, which is 0 when
+	// it doesn't exist
+	fileShardDepthMarker = ".shardDepth"
+	// File marking a folder whose key files may be in the layouts of any
+	// depth, until Rebalance is done
+	fileRebalanceMarker = ".rebalance"
+)
+
+func keyHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// shardNames returns the names of the depth nested shard folders of the
+// key, one hex encoded byte of the key hash each.
+func shardNames(key string, depth int) []string {
+	hash := fmt.Sprintf("%08x", keyHash(key))
+	names := make([]string, depth)
+	for i := range names {
+		names[i] = hash[2*i : 2*i+2]
+	}
+	return names
+}
+
+// keyDir returns the folder of the key file for the shard depth, which is
+// the store folder itself for the flat layout of depth 0.
+func (file *FileStore) keyDir(key string, depth int) string {
+	if depth == 0 {
+		return file.Path
+	}
+
+	return path.Join(append([]string{file.Path, fileShardsDir}, shardNames(key, depth)...)...)
+}
+
+// findKey returns the folder holding the key file, see locateKey.
+func (file *FileStore) findKey(key string) (string, bool, error) {
+	dir, _, exists, err := file.locateKey(key)
+	return dir, exists, err
+}
+
+// locateKey returns the folder holding the key file and the folder it's
+// written to, see storeDepth. It looks in the layout written to, the
+// current layout and the flat layout first, so files stored before the
+// store was sharded can still be read. The layouts of the other shard
+// depths are only looked in while the rebalance marker exists. If the key
+// doesn't exist it returns the folder it's written to. Must be called while
+// holding the store lock.
+func (file *FileStore) locateKey(key string) (string, string, bool, error) {
+	storeDepth, err := file.storeDepth()
+	if err != nil {
+		return "", "", false, err
+	}
+	storeDir := file.keyDir(key, storeDepth)
+
+	depths := []int{storeDepth}
+	for _, depth := range []int{file.ShardDepth, 0} {
+		if !containsDepth(depths, depth) {
+			depths = append(depths, depth)
+		}
+	}
+	if dir, exists, err := file.findKeyDepths(key, depths); err != nil || exists {
+		return dir, storeDir, exists, err
+	}
+
+	rebalancing, err := fileExists(path.Join(file.Path, fileRebalanceMarker))
+	if err != nil {
+		return "", "", false, err
+	}
+	if rebalancing {
+		others := []int{}
+		for depth := 1; depth <= fileMaxShardDepth; depth++ {
+			if !containsDepth(depths, depth) {
+				others = append(others, depth)
+			}
+		}
+		if dir, exists, err := file.findKeyDepths(key, others); err != nil || exists {
+			return dir, storeDir, exists, err
+		}
+	}
+
+	return storeDir, storeDir, false, nil
+}
+
+func containsDepth(depths []int, depth int) bool {
+	for _, d := range depths {
+		if d == depth {
+			return true
+		}
+	}
+	return false
+}
+
+// storeDepth returns the shard depth key files are written to. It's the
+// depth recorded by the last Rebalance when it's not ShardDepth and no
+// rebalance is pending, as the store was then opened before a Rebalance
+// moved the files to another depth. The markers are read again every time,
+// as Rebalance may run in another process. Must be called while holding
+// the store lock.
+func (file *FileStore) storeDepth() (int, error) {
+	depth, recorded, err := file.layoutDepth()
+	if err != nil || !recorded || depth == file.ShardDepth {
+		return file.ShardDepth, err
+	}
+
+	rebalancing, err := fileExists(path.Join(file.Path, fileRebalanceMarker))
+	if err != nil {
+		return 0, err
+	}
+	if rebalancing {
+		return file.ShardDepth, nil
+	}
+
+	return depth, nil
+}
+
+// findKeyDepths returns the folder holding the key file in the layouts of
+// the depths, if any.
+func (file *FileStore) findKeyDepths(key string, depths []int) (string, bool, error) {
+	for _, depth := range depths {
+		dir := file.keyDir(key, depth)
+		exists, err := fileExists(path.Join(dir, encodeFileKey(key)))
+		if err != nil {
+			return "", false, err
+		}
+		if exists {
+			return dir, true, nil
+		}
+	}
+
+	return "", false, nil
+}
+
+// checkShardDepth leaves the rebalance marker when the shard depth of the
+// store is not the depth of the folder layout, so key files stored with the
+// previous depth can still be read until Rebalance is done.
+func (file *FileStore) checkShardDepth() error {
+	// Checks without the exclusive lock first, so opening stores at the
+	// depth of their layout doesn't wait for the writes of other processes
+	if depth, _, err := file.layoutDepth(); err != nil || depth == file.ShardDepth {
+		return err
+	}
+
+	unlock, err := file.lockStore(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	depth, _, err := file.layoutDepth()
+	if err != nil || depth == file.ShardDepth {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path.Join(file.Path, fileRebalanceMarker), []byte("rebalance\n"), 0666); err != nil {
+		return fmt.Errorf("Unable to write rebalance marker: %s", err.Error())
+	}
+
+	return nil
+}
+
+// layoutDepth returns the shard depth recorded by the last Rebalance, and
+// whether one was recorded. Stores never rebalanced have the flat layout.
+func (file *FileStore) layoutDepth() (int, bool, error) {
+	b, err := ioutil.ReadFile(path.Join(file.Path, fileShardDepthMarker))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, fmt.Errorf("Unable to read shard depth marker: %s", err.Error())
+	}
+
+	depth, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, false, fmt.Errorf("Unable to parse shard depth marker: %s", err.Error())
+	}
+
+	return depth, true, nil
+}
+
+// existingKeyPath returns the path of the key file, or ErrNotFound.
+func (file *FileStore) existingKeyPath(key string) (string, error) {
+	dir, exists, err := file.findKey(key)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", fmt.Errorf("Unable to find %s file: %w", key, ErrNotFound)
+	}
+
+	return path.Join(dir, encodeFileKey(key)), nil
+}
+
+// readKeys returns the keys of all the files in the store folder and in
+// the shard folders.
+func (file *FileStore) readKeys() ([]string, error) {
+	found := map[string]bool{}
+	if err := readDirKeys(file.Path, found); err != nil {
+		return nil, err
+	}
+
+	shardsPath := path.Join(file.Path, fileShardsDir)
+	err := filepath.Walk(shardsPath, func(filePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			if filePath == shardsPath && errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		if fileInfo.IsDir() {
+			return nil
+		}
+
+		// Skips hidden files, like the version files, and foreign files
+		if key, err := decodeFileKey(fileInfo.Name()); err == nil {
+			found[key] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read shard directories: %s", err.Error())
+	}
+
+	keys := make([]string, 0, len(found))
+	for key := range found {
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func readDirKeys(dir string, found map[string]bool) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("Unable to read directory %s: %s", dir, err.Error())
+	}
+
+	for _, fileInfo := range files {
+		if fileInfo.IsDir() {
+			continue
+		}
+
+		// Skips hidden files, like the version files, and foreign files
+		if key, err := decodeFileKey(fileInfo.Name()); err == nil {
+			found[key] = true
+		}
+	}
+
+	return nil
+}
+
+// Rebalance moves the files of every key, and their versions, to the
+// folders of the current shard depth and removes the emptied shard
+// folders. It's needed after changing the depth for listing to be fast
+// again, as reads fall back to the other layouts until then. It records
+// the depth of the layout, which processes that opened the store with
+// another depth write to from then on, and removes the rebalance marker
+// when done, along with the temp files left by interrupted writes of
+// previous versions.
+func (file *FileStore) Rebalance() error {
+	unlock, err := file.lockStore(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	keys, err := file.readKeys()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := file.rebalanceKey(key); err != nil {
+			return err
+		}
+	}
+
+	if err := file.removeEmptyShards(); err != nil {
+		return err
+	}
+
+	if err := file.removeTempFiles(); err != nil {
+		return err
+	}
+
+	depthMarker := []byte(strconv.Itoa(file.ShardDepth) + "\n")
+	if err := ioutil.WriteFile(path.Join(file.Path, fileShardDepthMarker), depthMarker, 0666); err != nil {
+		return fmt.Errorf("Unable to write shard depth marker: %s", err.Error())
+	}
+
+	if err := os.Remove(path.Join(file.Path, fileRebalanceMarker)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Unable to remove rebalance marker: %s", err.Error())
+	}
+
+	return nil
+}
+
+// rebalanceKey moves the key file found in other layouts to the current
+// one. Must be called while holding the exclusive store lock.
+func (file *FileStore) rebalanceKey(key string) error {
+	name := encodeFileKey(key)
+	storeDir := file.keyDir(key, file.ShardDepth)
+	stored, err := fileExists(path.Join(storeDir, name))
+	if err != nil {
+		return err
+	}
+
+	for depth := 0; depth <= fileMaxShardDepth; depth++ {
+		dir := file.keyDir(key, depth)
+		if dir == storeDir {
+			continue
+		}
+
+		exists, err := fileExists(path.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+
+		if stored {
+			// Left behind by a store interrupted before removing the
+			// older file
+			os.Remove(path.Join(dir, name))
+			os.Remove(versionPath(dir, key))
+			continue
+		}
+
+		if err := os.MkdirAll(storeDir, os.ModePerm); err != nil {
+			return fmt.Errorf("Unable to create directory %s: %s", storeDir, err.Error())
+		}
+
+		// Moves the version first, a key file without a version file would
+		// restart from version 0
+		if err := os.Rename(versionPath(dir, key), versionPath(storeDir, key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("Unable to move version file of %s: %s", key, err.Error())
+		}
+		if err := os.Rename(path.Join(dir, name), path.Join(storeDir, name)); err != nil {
+			return fmt.Errorf("Unable to move file of %s: %s", key, err.Error())
+		}
+		stored = true
+	}
+
+	return nil
+}
+
+// removeEmptyShards removes the shard folders left without key files,
+// deepest first. Folders with files are left, as removing them fails.
+func (file *FileStore) removeEmptyShards() error {
+	shardsPath := path.Join(file.Path, fileShardsDir)
+	dirs := []string{}
+	err := filepath.Walk(shardsPath, func(filePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			if filePath == shardsPath && errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		if fileInfo.IsDir() {
+			dirs = append(dirs, filePath)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to read shard directories: %s", err.Error())
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		os.Remove(dir)
+	}
+
+	return nil
+}
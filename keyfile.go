@@ -0,0 +1,111 @@
+package blobstore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/golang/glog"
+)
+
+// KeyFileProvider is a KeyProvider whose master keys are read from a local
+// JSON key file, like:
+//
+//	{
+//	  "currentKeyId": "2017-10",
+//	  "keys": {
+//	    "2017-10": "<base64 AES-256 key>",
+//	    "2017-01": "<base64 AES-256 key>"
+//	  }
+//	}
+//
+// Data keys are wrapped with the current key. To rotate keys, add a new key
+// and make it current, keeping the previous keys until every object is
+// rewrapped.
+type KeyFileProvider struct {
+	CurrentKeyID string
+	keys         map[string][]byte
+}
+
+type keyFile struct {
+	CurrentKeyID string            `json:"currentKeyId"`
+	Keys         map[string]string `json:"keys"`
+}
+
+// NewKeyFileProvider reads the master keys of the key file, which must only
+// be accessible by its owner unless allowReadable is set.
+func NewKeyFileProvider(path string, allowReadable bool) (*KeyFileProvider, error) {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to stat key file: %s", err.Error())
+	}
+	if fileInfo.Mode().Perm()&0077 != 0 {
+		if !allowReadable {
+			return nil, fmt.Errorf("Key file %s is accessible by other users, its mode must be 0600 or 0400", path)
+		}
+		glog.Warningf("Key file %s is accessible by other users", path)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read key file: %s", err.Error())
+	}
+
+	file := keyFile{}
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("Unable to parse key file: %s", err.Error())
+	}
+
+	provider := &KeyFileProvider{
+		CurrentKeyID: file.CurrentKeyID,
+		keys:         map[string][]byte{},
+	}
+	for id, encoded := range file.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decode key %s: %s", id, err.Error())
+		}
+		if len(key) != encryptionKeyLen {
+			return nil, fmt.Errorf("Key %s must be %d bytes, not %d", id, encryptionKeyLen, len(key))
+		}
+		provider.keys[id] = key
+	}
+
+	if _, ok := provider.keys[provider.CurrentKeyID]; !ok {
+		return nil, fmt.Errorf("Unable to find current key %s in key file", provider.CurrentKeyID)
+	}
+
+	return provider, nil
+}
+
+// WrapKey encrypts the data key with the current key using AES-GCM, and
+// returns the nonce followed by the ciphertext.
+func (provider *KeyFileProvider) WrapKey(dataKey []byte) (string, []byte, error) {
+	nonce, ciphertext, err := sealGCM(provider.keys[provider.CurrentKeyID], dataKey, []byte(provider.CurrentKeyID))
+	if err != nil {
+		return "", nil, err
+	}
+
+	return provider.CurrentKeyID, append(nonce, ciphertext...), nil
+}
+
+func (provider *KeyFileProvider) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	key, ok := provider.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("Unable to find key %s in key file", keyID)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := gcm.NonceSize()
+	if len(wrapped) < nonceSize {
+		return nil, fmt.Errorf("Wrapped key is too short")
+	}
+
+	return openGCM(key, wrapped[:nonceSize], wrapped[nonceSize:], []byte(keyID))
+}
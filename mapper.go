@@ -0,0 +1,469 @@
+package blobstore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	timeType  = reflect.TypeOf(time.Time{})
+	bytesType = reflect.TypeOf([]byte(nil))
+)
+
+// Layout of time.Time values formatted with %v, which older versions used
+// to store times.
+const legacyTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// Value of the marker stored at the path of a non nil pointer to a struct,
+// the pointer is nil if the marker is empty.
+const structMarker = "{}"
+
+// Path element of the marker of pointers to values that can be formatted as
+// an empty string, holding structMarker when the pointer is not nil, so a
+// pointer to an empty value isn't loaded as nil.
+const pointerMarker = "*"
+
+var stringType = reflect.TypeOf("")
+
+// flattenFields calls fn with the path and value of every value of the
+// struct v points to, for stores that hold a flat list of named values.
+// Nested struct fields are named by their path, like Spec.Replicas, slice
+// elements by their index, like Tags.0, and map values by their key, like
+// Labels.app. Slices, maps and pointers to structs also get a marker string
+// at their own path, holding the slice length, the JSON list of map keys or
+// structMarker, or an empty string when they are nil. Markers let values
+// be read back without listing the stored paths, so stale values of a
+// shrunk slice or map are never read. Pointers to strings and byte slices
+// get a pointerMarker next to their value, like Owner.*.
+// Fields are named by their blobstore tag, or their json tag if they have
+// none, like `blobstore:"name,omitempty,noindex"`. fn is called with an
+// invalid value for empty fields tagged omitempty, stores that keep the
+// values of fields not written must store an empty value for them. noIndex
+// is set for the values of fields tagged noindex and their nested values.
+func flattenFields(v interface{}, fn flattenFunc) error {
+	if v == nil {
+		return nil
+	}
+
+	modelReflect := reflect.ValueOf(v)
+	if modelReflect.Kind() != reflect.Ptr || modelReflect.IsNil() {
+		return nil
+	}
+	if modelReflect.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Unable to map %T, it's not a struct pointer", v)
+	}
+
+	return flattenStruct("", modelReflect.Elem(), false, fn)
+}
+
+// flattenFunc is called with the path and value of every flattened value.
+type flattenFunc func(path string, value reflect.Value, noIndex bool) error
+
+func flattenStruct(prefix string, v reflect.Value, noIndex bool, fn flattenFunc) error {
+	return visitFields(v, false, func(field reflect.Value, tag fieldTag) error {
+		path := joinPath(prefix, tag.name)
+		if tag.omitEmpty && isEmptyValue(field) {
+			if hasPointerMarker(field.Type()) {
+				if err := fn(joinPath(path, pointerMarker), reflect.Value{}, noIndex || tag.noIndex); err != nil {
+					return err
+				}
+			}
+			return fn(path, reflect.Value{}, noIndex || tag.noIndex)
+		}
+		return flattenValue(path, field, noIndex || tag.noIndex, fn)
+	})
+}
+
+func flattenValue(path string, v reflect.Value, noIndex bool, fn flattenFunc) error {
+	if isValueType(v.Type()) {
+		if hasPointerMarker(v.Type()) {
+			marker := ""
+			if !v.IsNil() {
+				marker = structMarker
+			}
+			if err := fn(joinPath(path, pointerMarker), reflect.ValueOf(marker), noIndex); err != nil {
+				return err
+			}
+		}
+		return fn(path, v, noIndex)
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		return flattenStruct(path, v, noIndex, fn)
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return fn(path, reflect.ValueOf(""), noIndex)
+		}
+		if v.Kind() == reflect.Ptr && v.Elem().Kind() == reflect.Struct {
+			if err := fn(path, reflect.ValueOf(structMarker), noIndex); err != nil {
+				return err
+			}
+			return flattenStruct(path, v.Elem(), noIndex, fn)
+		}
+		return flattenValue(path, v.Elem(), noIndex, fn)
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return fn(path, reflect.ValueOf(""), noIndex)
+		}
+		if err := fn(path, reflect.ValueOf(strconv.Itoa(v.Len())), noIndex); err != nil {
+			return err
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := flattenValue(joinPath(path, strconv.Itoa(i)), v.Index(i), noIndex, fn); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if !isValueType(v.Type().Key()) {
+			return nil
+		}
+		if v.IsNil() {
+			return fn(path, reflect.ValueOf(""), noIndex)
+		}
+
+		keys := []string{}
+		values := map[string]reflect.Value{}
+		for _, key := range v.MapKeys() {
+			text := formatValue(key)
+			keys = append(keys, text)
+			values[text] = v.MapIndex(key)
+		}
+		sort.Strings(keys)
+
+		b, err := json.Marshal(keys)
+		if err != nil {
+			return fmt.Errorf("Unable to marshal %s keys: %s", path, err.Error())
+		}
+		if err := fn(path, reflect.ValueOf(string(b)), noIndex); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := flattenValue(joinPath(path, escapePathKey(key)), values[key], noIndex, fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// unflattenFields sets the fields of the struct v points to from the values
+// stored by flattenFields. lookup returns the text of the value stored at
+// the path, parsed by the type t, and whether it's stored. Values that
+// are not stored are set to zero, like slices, maps and pointers to
+// structs without a marker. Structs stored by older versions, which had
+// the fields of struct pointers and interfaces under their own names,
+// are read when they have no marker, and fields with a tag name are read
+// from their Go field name when nothing is stored under the tag name.
+func unflattenFields(v interface{}, lookup func(path string, t reflect.Type) (string, bool)) error {
+	if v == nil {
+		return nil
+	}
+
+	modelReflect := reflect.ValueOf(v)
+	if modelReflect.Kind() != reflect.Ptr || modelReflect.IsNil() {
+		return nil
+	}
+	if modelReflect.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Unable to map %T, it's not a struct pointer", v)
+	}
+
+	return unflattenStruct("", modelReflect.Elem(), lookup)
+}
+
+func unflattenStruct(prefix string, v reflect.Value, lookup func(path string, t reflect.Type) (string, bool)) error {
+	return visitFields(v, true, func(field reflect.Value, tag fieldTag) error {
+		path := joinPath(prefix, tag.name)
+		// Values stored before tags were read are named by the Go fields
+		if tag.name != tag.fieldName && !isStored(path, field.Type(), lookup) {
+			path = joinPath(prefix, tag.fieldName)
+		}
+		return unflattenValue(path, field, lookup)
+	})
+}
+
+// isStored returns whether a value of the type is stored at the path, which
+// for structs is whether any of their fields is stored.
+func isStored(path string, t reflect.Type, lookup func(path string, t reflect.Type) (string, bool)) bool {
+	if t.Kind() != reflect.Struct || isValueType(t) {
+		_, ok := lookup(path, t)
+		return ok
+	}
+
+	stored := false
+	visitFields(reflect.New(t).Elem(), false, func(field reflect.Value, tag fieldTag) error {
+		stored = stored || isStored(joinPath(path, tag.name), field.Type(), lookup)
+		return nil
+	})
+	return stored
+}
+
+func unflattenValue(path string, v reflect.Value, lookup func(path string, t reflect.Type) (string, bool)) error {
+	if isValueType(v.Type()) {
+		text, _ := lookup(path, v.Type())
+		if text == "" && hasPointerMarker(v.Type()) {
+			if marker, _ := lookup(joinPath(path, pointerMarker), stringType); marker == structMarker {
+				v.Set(reflect.New(v.Type().Elem()))
+				return nil
+			}
+		}
+		if err := parseValue(v, text); err != nil {
+			return fmt.Errorf("Unable to parse %s value: %s", path, err.Error())
+		}
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		return unflattenStruct(path, v, lookup)
+	case reflect.Ptr:
+		marker, ok := lookup(path, stringType)
+		if !ok {
+			if v.Type().Elem().Kind() == reflect.Struct && !v.IsNil() {
+				return unflattenStruct("", v.Elem(), lookup)
+			}
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		if marker == "" {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		if v.Elem().Kind() == reflect.Struct {
+			return unflattenStruct(path, v.Elem(), lookup)
+		}
+		return unflattenValue(path, v.Elem(), lookup)
+	case reflect.Interface:
+		// Only pointers set before loading can be loaded into, as the
+		// type of the value is not stored
+		if v.IsNil() || v.Elem().Kind() != reflect.Ptr || v.Elem().IsNil() || v.Elem().Elem().Kind() != reflect.Struct {
+			return nil
+		}
+		marker, ok := lookup(path, stringType)
+		if !ok {
+			return unflattenStruct("", v.Elem().Elem(), lookup)
+		}
+		if marker == "" {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		return unflattenStruct(path, v.Elem().Elem(), lookup)
+	case reflect.Slice, reflect.Array:
+		marker, _ := lookup(path, stringType)
+		if marker == "" {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		length, err := strconv.Atoi(marker)
+		if err != nil {
+			return fmt.Errorf("Unable to parse %s length: %s", path, err.Error())
+		}
+		if v.Kind() == reflect.Slice {
+			v.Set(reflect.MakeSlice(v.Type(), length, length))
+		} else if length > v.Len() {
+			length = v.Len()
+		}
+		for i := 0; i < length; i++ {
+			if err := unflattenValue(joinPath(path, strconv.Itoa(i)), v.Index(i), lookup); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if !isValueType(v.Type().Key()) {
+			return nil
+		}
+		marker, _ := lookup(path, stringType)
+		if marker == "" {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		keys := []string{}
+		if err := json.Unmarshal([]byte(marker), &keys); err != nil {
+			return fmt.Errorf("Unable to parse %s keys: %s", path, err.Error())
+		}
+		m := reflect.MakeMapWithSize(v.Type(), len(keys))
+		for _, text := range keys {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := parseValue(key, text); err != nil {
+				return fmt.Errorf("Unable to parse %s key: %s", path, err.Error())
+			}
+			value := reflect.New(v.Type().Elem()).Elem()
+			if err := unflattenValue(joinPath(path, escapePathKey(text)), value, lookup); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, value)
+		}
+		v.Set(m)
+	}
+
+	return nil
+}
+
+func joinPath(prefix string, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// escapePathKey escapes the map key so it's a single path element, which
+// also can't be mistaken for a part of a value split by the stores.
+func escapePathKey(key string) string {
+	return pathKeyEscaper.Replace(key)
+}
+
+var pathKeyEscaper = strings.NewReplacer("%", "%25", ".", "%2E", "_", "%5F")
+
+// isValueType returns whether values of the type are mapped to a single
+// attribute by formatValue and parseValue.
+func isValueType(t reflect.Type) bool {
+	if t == timeType || t == bytesType {
+		return true
+	}
+
+	switch t.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return true
+	case reflect.Ptr:
+		return isValueType(t.Elem())
+	}
+	return false
+}
+
+// hasPointerMarker returns whether the type is a pointer to a value that
+// formatValue can format as an empty string, which gets a pointerMarker.
+func hasPointerMarker(t reflect.Type) bool {
+	if t.Kind() != reflect.Ptr {
+		return false
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.String || t == bytesType
+}
+
+// formatValue formats the value as text for stores that only hold strings.
+// Nil pointers are formatted as an empty string. Types that are not value
+// types are formatted with %v and can't be parsed back.
+func formatValue(v reflect.Value) string {
+	if v.Type() == timeType {
+		return v.Interface().(time.Time).Format(time.RFC3339Nano)
+	}
+
+	if v.Type() == bytesType {
+		return base64.StdEncoding.EncodeToString(v.Bytes())
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.String:
+		return v.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits())
+	case reflect.Complex64, reflect.Complex128:
+		return strconv.FormatComplex(v.Complex(), 'g', -1, v.Type().Bits())
+	case reflect.Ptr:
+		if v.IsNil() {
+			return ""
+		}
+		return formatValue(v.Elem())
+	}
+
+	return fmt.Sprintf("%v", v.Interface())
+}
+
+// parseValue sets the field to the value parsed from text created by
+// formatValue. An empty text sets the zero value, which is nil for
+// pointers. Fields that are not value types are left unchanged.
+func parseValue(field reflect.Value, text string) error {
+	if !isValueType(field.Type()) {
+		return nil
+	}
+
+	if text == "" {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+
+	if field.Type() == timeType {
+		t, err := time.Parse(time.RFC3339Nano, text)
+		if err != nil {
+			// Times stored by older versions
+			if t, err = time.Parse(legacyTimeLayout, text); err != nil {
+				return err
+			}
+		}
+		field.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	if field.Type() == bytesType {
+		b, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return err
+		}
+		field.SetBytes(b)
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.String:
+		field.SetString(text)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(text, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, err := strconv.ParseUint(text, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(text, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Complex64, reflect.Complex128:
+		c, err := strconv.ParseComplex(text, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetComplex(c)
+	case reflect.Ptr:
+		elem := reflect.New(field.Type().Elem())
+		if err := parseValue(elem.Elem(), text); err != nil {
+			return err
+		}
+		field.Set(elem)
+	}
+
+	return nil
+}
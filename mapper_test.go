@@ -0,0 +1,156 @@
+package blobstore
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type typedFields struct {
+	String   string
+	Bool     bool
+	Int      int
+	Int8     int8
+	Int64    int64
+	Uint     uint
+	Uint64   uint64
+	Float32  float32
+	Float64  float64
+	Complex  complex128
+	Time     time.Time
+	Bytes    []byte
+	IntPtr   *int
+	TimePtr  *time.Time
+	NilPtr   *string
+	EmptyPtr *string
+	hidden   string
+	Interval time.Duration
+}
+
+func newTypedFields() *typedFields {
+	i := 42
+	empty := ""
+	t := time.Date(2017, 10, 3, 12, 30, 15, 123456000, time.UTC)
+	return &typedFields{
+		String:   "redis",
+		Bool:     true,
+		Int:      -12,
+		Int8:     -128,
+		Int64:    math.MinInt64,
+		Uint:     7,
+		Uint64:   math.MaxUint64,
+		Float32:  1.5,
+		Float64:  math.Pi,
+		Complex:  complex(1, -2),
+		Time:     t,
+		Bytes:    []byte{0, 1, 2, 255},
+		IntPtr:   &i,
+		TimePtr:  &t,
+		EmptyPtr: &empty,
+		hidden:   "not mapped",
+		Interval: 90 * time.Second,
+	}
+}
+
+func TestParseLegacyValues(t *testing.T) {
+	// Values formatted with %v by older versions
+	fields := &typedFields{}
+	assert.Nil(t, parseValue(reflectField(fields, "Time"), "2017-10-03 12:30:15.123456 +0000 UTC"))
+	assert.Equal(t, 2017, fields.Time.Year())
+	assert.Nil(t, parseValue(reflectField(fields, "Float64"), "1e+06"))
+	assert.Equal(t, 1e6, fields.Float64)
+
+	assert.NotNil(t, parseValue(reflectField(fields, "Int"), "abc"), "Parse error should not be nil")
+}
+
+func reflectField(fields *typedFields, name string) reflect.Value {
+	return reflect.ValueOf(fields).Elem().FieldByName(name)
+}
+
+type nestedSpec struct {
+	Name     string
+	Replicas int
+	Labels   map[string]string
+}
+
+type NestedBase struct {
+	Region string
+}
+
+type nestedFields struct {
+	NestedBase
+	Name     string
+	Spec     nestedSpec
+	SpecPtr  *nestedSpec
+	NilSpec  *nestedSpec
+	Tags     []string
+	NilTags  []string
+	NoTags   []string
+	Specs    []nestedSpec
+	Matrix   [][]int
+	Pair     [2]int
+	Counts   map[string]int
+	ByPort   map[int]*nestedSpec
+	Iface    interface{}
+	Deadline *time.Time
+}
+
+func newNestedFields() *nestedFields {
+	return &nestedFields{
+		NestedBase: NestedBase{Region: "us-east-1"},
+		Name:       "outer",
+		Spec: nestedSpec{
+			Name:     "inner",
+			Replicas: 3,
+			Labels:   map[string]string{"app": "redis", "tier.name": "cache", "a_1": "b"},
+		},
+		SpecPtr: &nestedSpec{Name: "pointer", Replicas: 1},
+		Tags:    []string{"a", "b.c", ""},
+		NoTags:  []string{},
+		Specs: []nestedSpec{
+			{Name: "first", Labels: map[string]string{}},
+			{Name: "second", Replicas: 2},
+		},
+		Matrix: [][]int{{1, 2}, {}, {3}},
+		Pair:   [2]int{4, 5},
+		Counts: map[string]int{"x": 1, "50%": 2},
+		ByPort: map[int]*nestedSpec{80: {Name: "http"}, 443: nil},
+		Iface:  &nestedSpec{Name: "interface"},
+	}
+}
+
+// loadNestedFields returns an object to load nestedFields into, with the
+// interface set to its type as it's not stored.
+func loadNestedFields() *nestedFields {
+	return &nestedFields{
+		Iface: &nestedSpec{},
+	}
+}
+
+func TestFlattenPaths(t *testing.T) {
+	values := map[string]string{}
+	err := flattenFields(newNestedFields(), func(path string, value reflect.Value, noIndex bool) error {
+		values[path] = formatValue(value)
+		return nil
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, "us-east-1", values["Region"])
+	assert.Equal(t, "outer", values["Name"])
+	assert.Equal(t, "inner", values["Spec.Name"])
+	assert.Equal(t, "3", values["Spec.Replicas"])
+	assert.Equal(t, "cache", values["Spec.Labels.tier%2Ename"])
+	assert.Equal(t, "pointer", values["SpecPtr.Name"])
+	assert.Equal(t, structMarker, values["SpecPtr"])
+	assert.Equal(t, "", values["NilSpec"])
+	assert.Equal(t, "3", values["Tags"])
+	assert.Equal(t, "b.c", values["Tags.1"])
+	assert.Equal(t, "second", values["Specs.1.Name"])
+	assert.Equal(t, "3", values["Matrix.2.0"])
+	assert.Equal(t, `["50%","x"]`, values["Counts"])
+	assert.Equal(t, "2", values["Counts.50%25"])
+	assert.Equal(t, "http", values["ByPort.80.Name"])
+}
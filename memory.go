@@ -0,0 +1,348 @@
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Memory store keeps each key value encoded by its Codec in a map, so
+// objects are copied on Store and Load just like with the serialized stores.
+// This is meant to be used for tests and ephemeral services.
+type MemoryStore struct {
+	Name string
+	// Codec encodes the values, JSON if not set
+	Codec       Codec
+	mutex       sync.RWMutex
+	objects     map[string]*memoryObject
+	lastVersion int64
+}
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+	version int64
+}
+
+func NewMemory(name string, config BlobStoreConfig) (*MemoryStore, error) {
+	// Memory stores don't need a config
+	var codec Codec = JSONCodec{}
+	if config != nil {
+		var err error
+		if codec, err = NewCodec(config); err != nil {
+			return nil, err
+		}
+	}
+
+	return &MemoryStore{
+		Name:    name,
+		Codec:   codec,
+		objects: map[string]*memoryObject{},
+	}, nil
+}
+
+// codec returns the codec of the object, see messageCodec.
+func (memory *MemoryStore) codec(object interface{}) Codec {
+	if memory.Codec == nil {
+		return messageCodec(JSONCodec{}, object)
+	}
+	return messageCodec(memory.Codec, object)
+}
+
+func (memory *MemoryStore) Store(key string, object interface{}) error {
+	return memory.StoreContext(context.Background(), key, object)
+}
+
+func (memory *MemoryStore) StoreContext(ctx context.Context, key string, object interface{}) error {
+	return memory.store(ctx, key, object, nil)
+}
+
+func (memory *MemoryStore) Create(key string, object interface{}) error {
+	return memory.CreateContext(context.Background(), key, object)
+}
+
+func (memory *MemoryStore) CreateContext(ctx context.Context, key string, object interface{}) error {
+	return memory.store(ctx, key, object, func(stored *memoryObject) error {
+		if stored != nil {
+			return fmt.Errorf("Unable to create %s, it already exists in memory store: %w", key, ErrConflict)
+		}
+		return nil
+	})
+}
+
+func (memory *MemoryStore) StoreIfVersion(key string, object interface{}, expectedVersion string) error {
+	return memory.StoreIfVersionContext(context.Background(), key, object, expectedVersion)
+}
+
+func (memory *MemoryStore) StoreIfVersionContext(ctx context.Context, key string, object interface{}, expectedVersion string) error {
+	return memory.store(ctx, key, object, func(stored *memoryObject) error {
+		if stored == nil {
+			return fmt.Errorf("Unable to find %s in memory store: %w", key, ErrNotFound)
+		}
+		if version := strconv.FormatInt(stored.version, 10); version != expectedVersion {
+			return fmt.Errorf("Unable to store %s, version %s is not %s: %w", key, version, expectedVersion, ErrConflict)
+		}
+		return nil
+	})
+}
+
+// store saves the object unless check, which is called with the currently
+// stored object or nil while holding the lock, returns an error.
+func (memory *MemoryStore) store(ctx context.Context, key string, object interface{}, check func(stored *memoryObject) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := validateKey(key, 0); err != nil {
+		return err
+	}
+
+	codec := memory.codec(object)
+	b, err := codec.Marshal(object)
+	if err != nil {
+		return fmt.Errorf("Unable to marshall object to %s: %s", codec.ContentType(), err.Error())
+	}
+
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+
+	if memory.objects == nil {
+		memory.objects = map[string]*memoryObject{}
+	}
+
+	if check != nil {
+		if err := check(memory.objects[key]); err != nil {
+			return err
+		}
+	}
+
+	memory.lastVersion++
+	memory.objects[key] = &memoryObject{
+		data:    b,
+		modTime: time.Now(),
+		version: memory.lastVersion,
+	}
+
+	return nil
+}
+
+func (memory *MemoryStore) Load(key string, object interface{}) error {
+	return memory.LoadContext(context.Background(), key, object)
+}
+
+func (memory *MemoryStore) LoadContext(ctx context.Context, key string, object interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := validateKey(key, 0); err != nil {
+		return err
+	}
+
+	if err := validateObject(object); err != nil {
+		return err
+	}
+
+	memory.mutex.RLock()
+	stored, ok := memory.objects[key]
+	memory.mutex.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("Unable to find %s in memory store: %w", key, ErrNotFound)
+	}
+
+	if err := memory.codec(object).Unmarshal(stored.data, object); err != nil {
+		return fmt.Errorf("Unable to decode object to struct: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (memory *MemoryStore) LoadAll(f func() interface{}) (interface{}, error) {
+	return memory.LoadAllContext(context.Background(), f)
+}
+
+func (memory *MemoryStore) LoadAllContext(ctx context.Context, f func() interface{}) (interface{}, error) {
+	_, items, _, err := memory.loadPage(ctx, f, "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+func (memory *MemoryStore) LoadPage(f func() interface{}, cursor string, limit int) (interface{}, string, error) {
+	return memory.LoadPageContext(context.Background(), f, cursor, limit)
+}
+
+func (memory *MemoryStore) LoadPageContext(ctx context.Context, f func() interface{}, cursor string, limit int) (interface{}, string, error) {
+	_, items, next, err := memory.loadPage(ctx, f, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return items, next, nil
+}
+
+func (memory *MemoryStore) Iterate(f func() interface{}, fn func(key string, object interface{}) error) error {
+	return iteratePages(context.Background(), memory.loadPage, f, fn)
+}
+
+// loadPage loads up to limit objects in key order after the cursor, which is
+// the last key of the previous page, and returns their keys and objects.
+func (memory *MemoryStore) loadPage(ctx context.Context, f func() interface{}, cursor string, limit int) ([]string, []interface{}, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, "", err
+	}
+
+	memory.mutex.RLock()
+	keys := make([]string, 0, len(memory.objects))
+	for key := range memory.objects {
+		keys = append(keys, key)
+	}
+	keys, next := pageKeys(keys, "", cursor, limit)
+	values := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, memory.objects[key].data)
+	}
+	memory.mutex.RUnlock()
+
+	items := []interface{}{}
+	for i, key := range keys {
+		v := f()
+		if err := memory.codec(v).Unmarshal(values[i], v); err != nil {
+			return nil, nil, "", fmt.Errorf("Unable to decode object %s: %s", key, err.Error())
+		}
+		items = append(items, v)
+	}
+
+	return keys, items, next, nil
+}
+
+func (memory *MemoryStore) Delete(key string) error {
+	return memory.DeleteContext(context.Background(), key)
+}
+
+func (memory *MemoryStore) DeleteContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := validateKey(key, 0); err != nil {
+		return err
+	}
+
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+
+	if _, ok := memory.objects[key]; !ok {
+		return fmt.Errorf("Unable to find %s in memory store: %w", key, ErrNotFound)
+	}
+	delete(memory.objects, key)
+
+	return nil
+}
+
+func (memory *MemoryStore) ListKeys(prefix string) ([]string, error) {
+	keys, _, err := memory.ListKeysPage(prefix, "", 0)
+	return keys, err
+}
+
+func (memory *MemoryStore) ListKeysPage(prefix string, cursor string, limit int) ([]string, string, error) {
+	return memory.ListKeysPageContext(context.Background(), prefix, cursor, limit)
+}
+
+func (memory *MemoryStore) ListKeysPageContext(ctx context.Context, prefix string, cursor string, limit int) ([]string, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	memory.mutex.RLock()
+	keys := make([]string, 0, len(memory.objects))
+	for key := range memory.objects {
+		keys = append(keys, key)
+	}
+	memory.mutex.RUnlock()
+
+	keys, next := pageKeys(keys, prefix, cursor, limit)
+	return keys, next, nil
+}
+
+func (memory *MemoryStore) Stat(key string) (*ObjectInfo, error) {
+	return memory.StatContext(context.Background(), key)
+}
+
+func (memory *MemoryStore) StatContext(ctx context.Context, key string) (*ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := validateKey(key, 0); err != nil {
+		return nil, err
+	}
+
+	memory.mutex.RLock()
+	defer memory.mutex.RUnlock()
+
+	stored, ok := memory.objects[key]
+	if !ok {
+		return &ObjectInfo{Key: key}, nil
+	}
+
+	return &ObjectInfo{
+		Key:     key,
+		Exists:  true,
+		Size:    int64(len(stored.data)),
+		ModTime: stored.modTime,
+		Version: strconv.FormatInt(stored.version, 10),
+	}, nil
+}
+
+func (memory *MemoryStore) StoreMulti(keys []string, objects []interface{}) error {
+	return memory.StoreMultiContext(context.Background(), keys, objects)
+}
+
+func (memory *MemoryStore) StoreMultiContext(ctx context.Context, keys []string, objects []interface{}) error {
+	if err := validateMulti(keys, objects); err != nil {
+		return err
+	}
+
+	errs := make([]error, len(keys))
+	for _, i := range uniqueIndexes(keys, errs) {
+		errs[i] = memory.StoreContext(ctx, keys[i], objects[i])
+	}
+
+	return multiError(errs)
+}
+
+func (memory *MemoryStore) LoadMulti(keys []string, objects []interface{}) error {
+	return memory.LoadMultiContext(context.Background(), keys, objects)
+}
+
+func (memory *MemoryStore) LoadMultiContext(ctx context.Context, keys []string, objects []interface{}) error {
+	if err := validateMulti(keys, objects); err != nil {
+		return err
+	}
+
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		errs[i] = memory.LoadContext(ctx, key, objects[i])
+	}
+
+	return multiError(errs)
+}
+
+func (memory *MemoryStore) DeleteMulti(keys []string) error {
+	return memory.DeleteMultiContext(context.Background(), keys)
+}
+
+func (memory *MemoryStore) DeleteMultiContext(ctx context.Context, keys []string) error {
+	errs := make([]error, len(keys))
+	for _, i := range uniqueIndexes(keys, errs) {
+		errs[i] = memory.DeleteContext(ctx, keys[i])
+	}
+
+	return multiError(errs)
+}
@@ -0,0 +1,40 @@
+package blobstore
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStoreCopiesObjects(t *testing.T) {
+	store, err := NewMemory("testStore", nil)
+	if err != nil {
+		panic(err)
+	}
+
+	deployment := &TestDeployment{Name: "redis", Type: "GCP"}
+	err = store.Store(deployment.Name, deployment)
+	assert.Nil(t, err, "Store error should be nil")
+
+	// Changes after Store should not leak into the stored value
+	deployment.Type = "AWS"
+
+	loaded := &TestDeployment{}
+	err = store.Load("redis", loaded)
+	assert.Nil(t, err, "Load error should be nil")
+	assert.Equal(t, "GCP", loaded.Type)
+
+	// Changes to a loaded value should not leak into the stored value
+	loaded.Type = "AWS"
+	reloaded := &TestDeployment{}
+	err = store.Load("redis", reloaded)
+	assert.Nil(t, err, "Load error should be nil")
+	assert.Equal(t, "GCP", reloaded.Type)
+
+	err = store.Delete("redis")
+	assert.Nil(t, err, "Delete error should be nil")
+
+	err = store.Load("redis", loaded)
+	assert.True(t, errors.Is(err, ErrNotFound), "Load error should be ErrNotFound after delete")
+}
@@ -0,0 +1,129 @@
+package blobstore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/hyperpilotio/blobstore/internal/testpb"
+	"github.com/stretchr/testify/assert"
+	datastore "google.golang.org/api/datastore/v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func newDeployment() *testpb.Deployment {
+	return &testpb.Deployment{
+		Name:     "redis",
+		Replicas: 3,
+		Labels:   map[string]string{"app": "redis", "tier": "cache"},
+		Containers: []*testpb.Container{
+			{Image: "redis:4", Ports: []int32{6379}, Config: []byte{0, 1, 255}},
+		},
+		Created: timestamppb.New(time.Date(2017, 10, 3, 12, 30, 15, 0, time.UTC)),
+		Target:  &testpb.Deployment_Zone{Zone: "us-east-1a"},
+	}
+}
+
+func TestProtoCodec(t *testing.T) {
+	for _, codec := range []ProtoCodec{{}, {JSON: true}} {
+		deployment := newDeployment()
+		b, err := codec.Marshal(deployment)
+		assert.Nil(t, err)
+
+		loaded := &testpb.Deployment{}
+		assert.Nil(t, codec.Unmarshal(b, loaded))
+		assert.True(t, proto.Equal(deployment, loaded), codec.ContentType())
+
+		_, err = codec.Marshal(newTaggedFields())
+		assert.NotNil(t, err, "Only proto messages should be encoded")
+	}
+}
+
+func TestMessageCodec(t *testing.T) {
+	deployment := newDeployment()
+	assert.Equal(t, ProtoCodec{JSON: true}, messageCodec(JSONCodec{}, deployment))
+	assert.Equal(t, ProtoCodec{}, messageCodec(MsgpackCodec{}, deployment))
+	assert.Equal(t, ProtoCodec{}, messageCodec(nil, deployment))
+	assert.Equal(t, ProtoCodec{JSON: true}, messageCodec(ProtoCodec{JSON: true}, deployment))
+	assert.Equal(t, MsgpackCodec{}, messageCodec(MsgpackCodec{}, newTaggedFields()))
+	assert.Nil(t, messageCodec(nil, newTaggedFields()))
+}
+
+func TestFileStoreProtoMessages(t *testing.T) {
+	store, err := NewFileStore("testStore")
+	if err != nil {
+		panic(err)
+	}
+
+	deployment := newDeployment()
+	assert.Nil(t, store.Store("redis", deployment), "Store error should be nil")
+
+	// JSON stores write canonical protojson
+	b, err := ioutil.ReadFile(path.Join(store.Path, "redis"))
+	assert.Nil(t, err)
+	decoded := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(b, &decoded))
+	assert.Equal(t, "2017-10-03T12:30:15Z", decoded["created"])
+	assert.Equal(t, "us-east-1a", decoded["zone"])
+
+	loaded := &testpb.Deployment{}
+	assert.Nil(t, store.Load("redis", loaded), "Load error should be nil")
+	assert.True(t, proto.Equal(deployment, loaded))
+
+	items, err := store.LoadAll(func() interface{} { return &testpb.Deployment{} })
+	assert.Nil(t, err, "LoadAll error should be nil")
+	assert.True(t, proto.Equal(deployment, items.([]interface{})[0].(proto.Message)))
+}
+
+func TestMemoryStoreProtoMessages(t *testing.T) {
+	store, err := NewMemory("testStore", nil)
+	if err != nil {
+		panic(err)
+	}
+	store.Codec = CBORCodec{}
+
+	deployment := newDeployment()
+	assert.Nil(t, store.Store("redis", deployment), "Store error should be nil")
+
+	loaded := &testpb.Deployment{}
+	assert.Nil(t, store.Load("redis", loaded), "Load error should be nil")
+	assert.True(t, proto.Equal(deployment, loaded))
+}
+
+func TestSimpleDBProtoMessages(t *testing.T) {
+	db := &SimpleDB{}
+	deployment := newDeployment()
+	replaceable, err := db.versionedAttributes(deployment)
+	assert.Nil(t, err)
+
+	attributes := map[string]string{}
+	for _, attribute := range replaceable {
+		attributes[*attribute.Name] = *attribute.Value
+	}
+	assert.Equal(t, "1 application/x-protobuf", attributes[simpledbBlobAttribute])
+
+	loaded := &testpb.Deployment{}
+	assert.Nil(t, db.setValue(loaded, simpledbItemAttributes(attributes)))
+	assert.True(t, proto.Equal(deployment, loaded))
+}
+
+func TestDatastoreProtoMessages(t *testing.T) {
+	db := &DatastoreDB{}
+	deployment := newDeployment()
+	entity, err := db.entity("redis", deployment)
+	assert.Nil(t, err)
+	assert.Equal(t, "application/x-protobuf", entity.Properties[datastoreContentTypeProperty].StringValue)
+
+	// Values read back from the API as JSON
+	b, err := json.Marshal(entity.Properties)
+	assert.Nil(t, err)
+	props := map[string]datastore.Value{}
+	assert.Nil(t, json.Unmarshal(b, &props))
+
+	loaded := &testpb.Deployment{}
+	assert.Nil(t, setEntityValue(loaded, props, nil))
+	assert.True(t, proto.Equal(deployment, loaded))
+}
@@ -1,24 +1,52 @@
 package blobstore
 
 import (
-	"errors"
+	"context"
+	"encoding/base64"
 	"fmt"
 	"reflect"
 	"strconv"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/simpledb"
 	"github.com/golang/glog"
 )
 
+const (
+	// SimpleDB item names can not be greater than 1024 bytes
+	simpledbMaxKeyLen = 1024
+	// SimpleDB batch puts and deletes can not have more than 25 items
+	simpledbBatchSize = 25
+	// SimpleDB in comparisons can not have more than 20 values
+	simpledbMaxInValues = 20
+	// Attribute holding the version of each item, which can't collide
+	// with the attributes of struct fields
+	simpledbVersionAttribute = "@version"
+	// Version of items stored before versions were kept
+	simpledbLegacyVersion = "0"
+	// Error code of puts whose expected condition is not met
+	simpledbConditionalCheckFailed = "ConditionalCheckFailed"
+	// Attribute holding the part count and content type of the encoded
+	// object in blob mode and for proto messages, whose parts are in numbered
+	// attributes
+	simpledbBlobAttribute = "@blob"
+	// SimpleDB attribute value can not be greater than 1024
+	simpledbMaxValueLen = 1024
+)
+
 type SimpleDB struct {
-	Name        string
-	domainName  string
-	Region      string
-	Config      BlobStoreConfig
+	Name       string
+	domainName string
+	Region     string
+	Config     BlobStoreConfig
+	// Codec encodes objects to a single blob when set, instead of storing
+	// their fields as attributes. Blobs are compressed with Compression.
+	Codec       Codec
+	Compression Compression
 	simpledbSvc *simpledb.SimpleDB
 }
 
@@ -26,129 +54,415 @@ func NewSimpleDB(name string, config BlobStoreConfig) (*SimpleDB, error) {
 	region := strings.ToLower(config.GetString("store.region"))
 	session, err := createSessionByRegion(config, region)
 	if err != nil {
-		return nil, errors.New("Unable to create aws session: " + err.Error())
+		return nil, fmt.Errorf("Unable to create aws session: %w", err)
+	}
+
+	codec, err := newBlobCodec(config)
+	if err != nil {
+		return nil, err
+	}
+
+	compression, err := NewCompression(config)
+	if err != nil {
+		return nil, err
 	}
 
 	simpledbSvc := simpledb.New(session)
 	domainName := getDomainName(name, config)
 	if err := createDomain(simpledbSvc, config, domainName); err != nil {
-		return nil, errors.New("Unable to create simpledb domain: " + err.Error())
+		return nil, simpledbError("Unable to create simpledb domain", err)
 	}
 
 	return &SimpleDB{
 		Name:        name,
 		Region:      region,
 		Config:      config,
+		Codec:       codec,
+		Compression: compression,
 		simpledbSvc: simpledbSvc,
 		domainName:  domainName,
 	}, nil
 }
 
+// simpledbRequestError is an AWS error that also unwraps to its original
+// error, like the context error of a cancelled request.
+type simpledbRequestError struct {
+	awsErr awserr.Error
+}
+
+func (err simpledbRequestError) Error() string {
+	return err.awsErr.Error()
+}
+
+func (err simpledbRequestError) Unwrap() []error {
+	if err.awsErr.OrigErr() == nil {
+		return []error{err.awsErr}
+	}
+	return []error{err.awsErr, err.awsErr.OrigErr()}
+}
+
+// simpledbError wraps the error of a SimpleDB request, so callers can match
+// its original error with errors.Is.
+func simpledbError(message string, err error) error {
+	if awsErr, ok := err.(awserr.Error); ok {
+		err = simpledbRequestError{awsErr}
+	}
+	return fmt.Errorf("%s: %w", message, err)
+}
+
 func createDomain(simpledbSvc *simpledb.SimpleDB, config BlobStoreConfig, domainName string) error {
 	createDomainInput := &simpledb.CreateDomainInput{
 		DomainName: aws.String(domainName),
 	}
 
 	if _, err := simpledbSvc.CreateDomain(createDomainInput); err != nil {
-		return errors.New("Unable to create simpleDB domain: " + err.Error())
+		return simpledbError("Unable to create simpleDB domain", err)
 	}
 
 	return nil
 }
 
 func (db *SimpleDB) Store(key string, object interface{}) error {
-	attributes := []*simpledb.ReplaceableAttribute{}
-	recursiveStructField(&attributes, object)
+	return db.StoreContext(context.Background(), key, object)
+}
+
+func (db *SimpleDB) StoreContext(ctx context.Context, key string, object interface{}) error {
+	return db.put(ctx, key, object, nil)
+}
+
+// Items stored before versions were kept have no version attribute, so the
+// stored attributes are checked before the conditional put, which only
+// covers the version attribute that every item stored since has. Their
+// version is "0", like FileStore keys without a version file.
+func (db *SimpleDB) Create(key string, object interface{}) error {
+	return db.CreateContext(context.Background(), key, object)
+}
+
+func (db *SimpleDB) CreateContext(ctx context.Context, key string, object interface{}) error {
+	return db.put(ctx, key, object, func(stored []*simpledb.Attribute) (*simpledb.UpdateCondition, error) {
+		if len(stored) > 0 {
+			return nil, fmt.Errorf("Unable to create %s, it already exists in simpleDB: %w", key, ErrConflict)
+		}
+		return &simpledb.UpdateCondition{
+			Name:   aws.String(simpledbVersionAttribute),
+			Exists: aws.Bool(false),
+		}, nil
+	})
+}
+
+func (db *SimpleDB) StoreIfVersion(key string, object interface{}, expectedVersion string) error {
+	return db.StoreIfVersionContext(context.Background(), key, object, expectedVersion)
+}
+
+func (db *SimpleDB) StoreIfVersionContext(ctx context.Context, key string, object interface{}, expectedVersion string) error {
+	return db.put(ctx, key, object, func(stored []*simpledb.Attribute) (*simpledb.UpdateCondition, error) {
+		if len(stored) == 0 {
+			return nil, fmt.Errorf("Unable to find %s data from simpleDB: %w", key, ErrNotFound)
+		}
+		if version := attributesVersion(stored); version != expectedVersion {
+			return nil, fmt.Errorf("Unable to store %s, version %s is not %s: %w", key, version, expectedVersion, ErrConflict)
+		}
+		if expectedVersion == simpledbLegacyVersion {
+			return &simpledb.UpdateCondition{
+				Name:   aws.String(simpledbVersionAttribute),
+				Exists: aws.Bool(false),
+			}, nil
+		}
+		return &simpledb.UpdateCondition{
+			Name:   aws.String(simpledbVersionAttribute),
+			Value:  aws.String(expectedVersion),
+			Exists: aws.Bool(true),
+		}, nil
+	})
+}
+
+// attributesVersion returns the version of the item with the attributes.
+func attributesVersion(attributes []*simpledb.Attribute) string {
+	for _, attribute := range attributes {
+		if aws.StringValue(attribute.Name) == simpledbVersionAttribute {
+			return aws.StringValue(attribute.Value)
+		}
+	}
+
+	return simpledbLegacyVersion
+}
+
+// put stores the object attributes with a new version and deletes the
+// attributes of the other storage mode, see staleAttributes. If check is
+// set, it's called with the stored attributes, which are empty if the item
+// doesn't exist, and returns the expected condition of the put.
+func (db *SimpleDB) put(ctx context.Context, key string, object interface{}, check func(stored []*simpledb.Attribute) (*simpledb.UpdateCondition, error)) error {
+	if err := validateKey(key, simpledbMaxKeyLen); err != nil {
+		return err
+	}
+
+	attributes, err := db.versionedAttributes(object)
+	if err != nil {
+		return err
+	}
+
+	getAttributesInput := &simpledb.GetAttributesInput{
+		DomainName:     aws.String(db.domainName),
+		ItemName:       aws.String(key),
+		ConsistentRead: aws.Bool(true),
+	}
+
+	resp, err := db.simpledbSvc.GetAttributesWithContext(ctx, getAttributesInput)
+	if err != nil {
+		return simpledbError("Unable to get attributes from simpleDB", err)
+	}
+
+	var expected *simpledb.UpdateCondition
+	if check != nil {
+		if expected, err = check(resp.Attributes); err != nil {
+			return err
+		}
+	}
 
 	putAttributesInput := &simpledb.PutAttributesInput{
 		Attributes: attributes,
 		DomainName: aws.String(db.domainName),
 		ItemName:   aws.String(key),
+		Expected:   expected,
 	}
 
-	if _, err := db.simpledbSvc.PutAttributes(putAttributesInput); err != nil {
-		return errors.New("Unable to put attributes to simpleDB: " + err.Error())
+	if _, err := db.simpledbSvc.PutAttributesWithContext(ctx, putAttributesInput); err != nil {
+		if awsErr, ok := err.(awserr.Error); ok {
+			switch awsErr.Code() {
+			case simpledbConditionalCheckFailed:
+				return fmt.Errorf("Unable to put attributes to simpleDB, version changed: %w", ErrConflict)
+			case simpledb.ErrCodeAttributeDoesNotExist:
+				return fmt.Errorf("Unable to find %s data from simpleDB: %w", key, ErrNotFound)
+			}
+		}
+		return simpledbError("Unable to put attributes to simpleDB", err)
+	}
+
+	return db.deleteStaleAttributes(ctx, key, attributes, resp.Attributes)
+}
+
+// staleAttributes returns the stored attributes that puts leave in place
+// and that would be read along with the written attributes: the parts of
+// values that were split and are now written whole or in fewer parts, the
+// whole values that are now split, and the attributes of the other storage
+// mode, which are the blob parts for attributes of struct fields, and the
+// attributes of struct fields for blobs.
+func staleAttributes(written []*simpledb.ReplaceableAttribute, stored []*simpledb.Attribute) []*simpledb.DeletableAttribute {
+	names := map[string]bool{}
+	bases := map[string]bool{}
+	blob := false
+	for _, attribute := range written {
+		name := aws.StringValue(attribute.Name)
+		names[name] = true
+		bases[name] = true
+		bases[splitBaseName(name)] = true
+		if name == simpledbBlobAttribute && aws.StringValue(attribute.Value) != "" {
+			blob = true
+		}
+	}
+
+	stale := []*simpledb.DeletableAttribute{}
+	for _, attribute := range stored {
+		name := aws.StringValue(attribute.Name)
+		if names[name] {
+			continue
+		}
+		if bases[name] || bases[splitBaseName(name)] || (blob && !strings.HasPrefix(name, "@")) {
+			stale = append(stale, &simpledb.DeletableAttribute{Name: attribute.Name})
+			// Multi valued attributes are deleted once
+			names[name] = true
+		}
+	}
+
+	return stale
+}
+
+// splitBaseName returns the name of the value a split part attribute is
+// named after, see appendAttributes, or the name itself.
+func splitBaseName(name string) string {
+	i := strings.LastIndex(name, "_")
+	if i < 0 || i == len(name)-1 {
+		return name
+	}
+	for _, c := range name[i+1:] {
+		if c < '0' || c > '9' {
+			return name
+		}
+	}
+
+	return name[:i]
+}
+
+// deleteStaleAttributes deletes the stale attributes of the item, unless it
+// was written again since the written attributes.
+func (db *SimpleDB) deleteStaleAttributes(ctx context.Context, key string, written []*simpledb.ReplaceableAttribute, stored []*simpledb.Attribute) error {
+	stale := staleAttributes(written, stored)
+	if len(stale) == 0 {
+		return nil
+	}
+
+	version := ""
+	for _, attribute := range written {
+		if aws.StringValue(attribute.Name) == simpledbVersionAttribute {
+			version = aws.StringValue(attribute.Value)
+		}
+	}
+
+	deleteAttributesInput := &simpledb.DeleteAttributesInput{
+		DomainName: aws.String(db.domainName),
+		ItemName:   aws.String(key),
+		Attributes: stale,
+		Expected: &simpledb.UpdateCondition{
+			Name:   aws.String(simpledbVersionAttribute),
+			Value:  aws.String(version),
+			Exists: aws.Bool(true),
+		},
+	}
+
+	if _, err := db.simpledbSvc.DeleteAttributesWithContext(ctx, deleteAttributesInput); err != nil {
+		// The item was written again, which deleted the stale attributes
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == simpledbConditionalCheckFailed {
+			return nil
+		}
+		return simpledbError("Unable to delete stale attributes from simpleDB", err)
 	}
 
 	return nil
 }
 
 func (db *SimpleDB) Load(key string, object interface{}) error {
-	if object == nil || reflect.ValueOf(object).IsNil() {
-		return errors.New("Unable to put attributes to nil struct...")
+	return db.LoadContext(context.Background(), key, object)
+}
+
+func (db *SimpleDB) LoadContext(ctx context.Context, key string, object interface{}) error {
+	if err := validateKey(key, simpledbMaxKeyLen); err != nil {
+		return err
+	}
+
+	if err := validateObject(object); err != nil {
+		return err
 	}
 
-	selectExpression := fmt.Sprintf("select * from `%s` where itemName() in ('%s')", db.domainName, key)
+	selectExpression := fmt.Sprintf("select * from %s where itemName() = %s",
+		quoteSelectName(db.domainName), quoteSelectValue(key))
 	selectInput := &simpledb.SelectInput{
 		SelectExpression: aws.String(selectExpression),
+		ConsistentRead:   aws.Bool(true),
 	}
 
-	selectOutput, err := db.simpledbSvc.Select(selectInput)
+	selectOutput, err := db.simpledbSvc.SelectWithContext(ctx, selectInput)
 	if err != nil {
-		return errors.New("Unable to select data from simpleDB: " + err.Error())
+		return simpledbError("Unable to select data from simpleDB", err)
 	}
 
-	for _, item := range selectOutput.Items {
-		getAttributesInput := &simpledb.GetAttributesInput{
-			DomainName: aws.String(db.domainName),
-			ItemName:   item.Name,
-		}
+	if len(selectOutput.Items) == 0 {
+		return fmt.Errorf("Unable to find %s data from simpleDB: %w", key, ErrNotFound)
+	}
+
+	return db.setValue(object, selectOutput.Items[0].Attributes)
+}
+
+func (db *SimpleDB) LoadAll(f func() interface{}) (interface{}, error) {
+	return db.LoadAllContext(context.Background(), f)
+}
 
-		resp, err := db.simpledbSvc.GetAttributes(getAttributesInput)
+func (db *SimpleDB) LoadAllContext(ctx context.Context, f func() interface{}) (interface{}, error) {
+	items := []interface{}{}
+	cursor := ""
+	for {
+		_, page, next, err := db.loadPage(ctx, f, cursor, 0)
 		if err != nil {
-			return errors.New("Unable to get attributes from simpleDB: " + err.Error())
+			return nil, err
 		}
-		recursiveSetValue(object, resp.Attributes)
+
+		items = append(items, page...)
+		if next == "" {
+			return items, nil
+		}
+		cursor = next
 	}
+}
 
-	return nil
+func (db *SimpleDB) LoadPage(f func() interface{}, cursor string, limit int) (interface{}, string, error) {
+	return db.LoadPageContext(context.Background(), f, cursor, limit)
 }
 
-func (db *SimpleDB) LoadAll(f func() interface{}) (interface{}, error) {
-	selectExpression := fmt.Sprintf("select * from `%s`", db.domainName)
+func (db *SimpleDB) LoadPageContext(ctx context.Context, f func() interface{}, cursor string, limit int) (interface{}, string, error) {
+	_, items, next, err := db.loadPage(ctx, f, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return items, next, nil
+}
+
+func (db *SimpleDB) Iterate(f func() interface{}, fn func(key string, object interface{}) error) error {
+	return iteratePages(context.Background(), db.loadPage, f, fn)
+}
+
+// loadPage selects up to limit items continuing from the cursor, which is
+// the NextToken of the previous select, and returns their keys and objects.
+func (db *SimpleDB) loadPage(ctx context.Context, f func() interface{}, cursor string, limit int) ([]string, []interface{}, string, error) {
+	selectExpression := fmt.Sprintf("select * from %s", quoteSelectName(db.domainName))
+	if limit > 0 {
+		// SimpleDB select limit can not be greater than 2500
+		if limit > 2500 {
+			limit = 2500
+		}
+		selectExpression += fmt.Sprintf(" limit %d", limit)
+	}
+
 	selectInput := &simpledb.SelectInput{
 		SelectExpression: aws.String(selectExpression),
+		ConsistentRead:   aws.Bool(true),
+	}
+	if cursor != "" {
+		selectInput.NextToken = aws.String(cursor)
 	}
 
-	selectOutput, err := db.simpledbSvc.Select(selectInput)
+	selectOutput, err := db.simpledbSvc.SelectWithContext(ctx, selectInput)
 	if err != nil {
-		return nil, errors.New("Unable to select data from simpleDB: " + err.Error())
+		return nil, nil, "", simpledbError("Unable to select data from simpleDB", err)
 	}
 
+	keys := []string{}
 	items := []interface{}{}
 	for _, item := range selectOutput.Items {
-		getAttributesInput := &simpledb.GetAttributesInput{
-			DomainName: aws.String(db.domainName),
-			ItemName:   item.Name,
-		}
-
-		resp, err := db.simpledbSvc.GetAttributes(getAttributesInput)
-		if err != nil {
-			return nil, errors.New("Unable to get attributes from simpleDB: " + err.Error())
-		}
-
 		v := f()
-		recursiveSetValue(v, resp.Attributes)
+		if err := db.setValue(v, item.Attributes); err != nil {
+			return nil, nil, "", err
+		}
 
+		keys = append(keys, aws.StringValue(item.Name))
 		items = append(items, v)
 	}
 
-	return items, nil
+	return keys, items, aws.StringValue(selectOutput.NextToken), nil
 }
 
 func (db *SimpleDB) Delete(key string) error {
-	selectExpression := fmt.Sprintf("select * from `%s` where itemName()='%s'", db.domainName, key)
+	return db.DeleteContext(context.Background(), key)
+}
+
+func (db *SimpleDB) DeleteContext(ctx context.Context, key string) error {
+	if err := validateKey(key, simpledbMaxKeyLen); err != nil {
+		return err
+	}
+
+	selectExpression := fmt.Sprintf("select * from %s where itemName() = %s",
+		quoteSelectName(db.domainName), quoteSelectValue(key))
 	selectInput := &simpledb.SelectInput{
 		SelectExpression: aws.String(selectExpression),
+		ConsistentRead:   aws.Bool(true),
 	}
 
-	selectOutput, err := db.simpledbSvc.Select(selectInput)
+	selectOutput, err := db.simpledbSvc.SelectWithContext(ctx, selectInput)
 	if err != nil {
-		return errors.New("Unable to select data from simpleDB: " + err.Error())
+		return simpledbError("Unable to select data from simpleDB", err)
 	}
 
 	if len(selectOutput.Items) == 0 {
-		return fmt.Errorf("Unable to find %s data from simpleDB", key)
+		return fmt.Errorf("Unable to find %s data from simpleDB: %w", key, ErrNotFound)
 	}
 
 	deleteAttributesInput := &simpledb.DeleteAttributesInput{
@@ -156,84 +470,498 @@ func (db *SimpleDB) Delete(key string) error {
 		ItemName:   selectOutput.Items[0].Name,
 	}
 
-	if _, err := db.simpledbSvc.DeleteAttributes(deleteAttributesInput); err != nil {
-		return fmt.Errorf("Unable to delete %s attributes from simpleDB: %s", key, err.Error())
+	if _, err := db.simpledbSvc.DeleteAttributesWithContext(ctx, deleteAttributesInput); err != nil {
+		return simpledbError(fmt.Sprintf("Unable to delete %s attributes from simpleDB", key), err)
 	}
 
 	return nil
 }
 
-func recursiveSetValue(v interface{}, attributes []*simpledb.Attribute) {
-	if v == nil || reflect.ValueOf(v).IsNil() {
-		return
+func (db *SimpleDB) ListKeys(prefix string) ([]string, error) {
+	keys := []string{}
+	cursor := ""
+	for {
+		page, next, err := db.ListKeysPage(prefix, cursor, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, page...)
+		if next == "" {
+			return keys, nil
+		}
+		cursor = next
 	}
+}
 
-	modelReflect := reflect.ValueOf(v).Elem()
-	modelRefType := modelReflect.Type()
-	fieldsCount := modelReflect.NumField()
+func (db *SimpleDB) ListKeysPage(prefix string, cursor string, limit int) ([]string, string, error) {
+	return db.ListKeysPageContext(context.Background(), prefix, cursor, limit)
+}
+
+func (db *SimpleDB) ListKeysPageContext(ctx context.Context, prefix string, cursor string, limit int) ([]string, string, error) {
+	selectExpression := fmt.Sprintf("select itemName() from %s where itemName() like %s order by itemName()",
+		quoteSelectName(db.domainName), quoteSelectValue(escapeLike(prefix)+"%"))
+	if limit > 0 {
+		// SimpleDB select limit can not be greater than 2500
+		if limit > 2500 {
+			limit = 2500
+		}
+		selectExpression += fmt.Sprintf(" limit %d", limit)
+	}
 
-	for i := 0; i < fieldsCount; i++ {
-		field := modelReflect.Field(i)
-		fieldName := modelRefType.Field(i).Name
+	selectInput := &simpledb.SelectInput{
+		SelectExpression: aws.String(selectExpression),
+		ConsistentRead:   aws.Bool(true),
+	}
+	if cursor != "" {
+		selectInput.NextToken = aws.String(cursor)
+	}
 
-		switch field.Kind() {
-		case reflect.Interface:
-			recursiveSetValue(field.Interface(), attributes)
-		default:
-			attrValue := restoreValue(fieldName, attributes)
-			field.Set(reflect.ValueOf(attrValue))
+	selectOutput, err := db.simpledbSvc.SelectWithContext(ctx, selectInput)
+	if err != nil {
+		return nil, "", simpledbError("Unable to select item names from simpleDB", err)
+	}
+
+	keys := []string{}
+	for _, item := range selectOutput.Items {
+		keys = append(keys, aws.StringValue(item.Name))
+	}
+
+	return keys, aws.StringValue(selectOutput.NextToken), nil
+}
+
+func (db *SimpleDB) Stat(key string) (*ObjectInfo, error) {
+	return db.StatContext(context.Background(), key)
+}
+
+func (db *SimpleDB) StatContext(ctx context.Context, key string) (*ObjectInfo, error) {
+	if err := validateKey(key, simpledbMaxKeyLen); err != nil {
+		return nil, err
+	}
+
+	getAttributesInput := &simpledb.GetAttributesInput{
+		DomainName:     aws.String(db.domainName),
+		ItemName:       aws.String(key),
+		ConsistentRead: aws.Bool(true),
+	}
+
+	resp, err := db.simpledbSvc.GetAttributesWithContext(ctx, getAttributesInput)
+	if err != nil {
+		return nil, simpledbError("Unable to get attributes from simpleDB", err)
+	}
+
+	// SimpleDB items only exist while they have attributes
+	if len(resp.Attributes) == 0 {
+		return &ObjectInfo{Key: key}, nil
+	}
+
+	// The size only counts the object values, like the other stores, so
+	// internal attributes are left out and blob parts count as the decoded
+	// blob
+	size := 0
+	blobLen, blobPadding := 0, 0
+	version := simpledbLegacyVersion
+	for _, attribute := range resp.Attributes {
+		name, value := aws.StringValue(attribute.Name), aws.StringValue(attribute.Value)
+		switch {
+		case name == simpledbVersionAttribute:
+			version = value
+		case strings.HasPrefix(name, simpledbBlobAttribute+"_"):
+			blobLen += len(value)
+			blobPadding += strings.Count(value, "=")
+		case !strings.HasPrefix(name, "@"):
+			size += len(value)
 		}
 	}
+	if blobLen > 0 {
+		size += blobLen/4*3 - blobPadding
+	}
+
+	return &ObjectInfo{
+		Key:        key,
+		Exists:     true,
+		Size:       int64(size),
+		Version:    version,
+		Attributes: len(resp.Attributes),
+	}, nil
 }
 
-func recursiveStructField(attrs *[]*simpledb.ReplaceableAttribute, v interface{}) {
-	if v == nil || reflect.ValueOf(v).IsNil() {
-		return
+func (db *SimpleDB) StoreMulti(keys []string, objects []interface{}) error {
+	return db.StoreMultiContext(context.Background(), keys, objects)
+}
+
+func (db *SimpleDB) StoreMultiContext(ctx context.Context, keys []string, objects []interface{}) error {
+	if err := validateMulti(keys, objects); err != nil {
+		return err
+	}
+
+	errs := make([]error, len(keys))
+	db.validIndexes(keys, errs)
+	indexes := uniqueIndexes(keys, errs)
+	// Chunks are selected at once to find the stale attributes, so they
+	// are limited by the values of in comparisons, below the batch size
+	for _, chunk := range chunkIndexes(indexes, simpledbMaxInValues) {
+		stored, err := db.selectItems(ctx, "*", keys, chunk)
+		if err != nil {
+			for _, i := range chunk {
+				errs[i] = err
+			}
+			continue
+		}
+
+		items := []*simpledb.ReplaceableItem{}
+		written := map[int][]*simpledb.ReplaceableAttribute{}
+		for _, i := range chunk {
+			attributes, err := db.versionedAttributes(objects[i])
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			written[i] = attributes
+			items = append(items, &simpledb.ReplaceableItem{
+				Name:       aws.String(keys[i]),
+				Attributes: attributes,
+			})
+		}
+
+		if len(items) == 0 {
+			continue
+		}
+
+		batchPutAttributesInput := &simpledb.BatchPutAttributesInput{
+			DomainName: aws.String(db.domainName),
+			Items:      items,
+		}
+
+		if _, err := db.simpledbSvc.BatchPutAttributesWithContext(ctx, batchPutAttributesInput); err != nil {
+			for _, i := range chunk {
+				if errs[i] == nil {
+					errs[i] = simpledbError("Unable to batch put attributes to simpleDB", err)
+				}
+			}
+			continue
+		}
+
+		for i, attributes := range written {
+			errs[i] = db.deleteStaleAttributes(ctx, keys[i], attributes, stored[keys[i]])
+		}
+	}
+
+	return multiError(errs)
+}
+
+func (db *SimpleDB) LoadMulti(keys []string, objects []interface{}) error {
+	return db.LoadMultiContext(context.Background(), keys, objects)
+}
+
+func (db *SimpleDB) LoadMultiContext(ctx context.Context, keys []string, objects []interface{}) error {
+	if err := validateMulti(keys, objects); err != nil {
+		return err
+	}
+
+	errs := make([]error, len(keys))
+	indexes := db.validIndexes(keys, errs)
+	for _, chunk := range chunkIndexes(indexes, simpledbMaxInValues) {
+		items, err := db.selectItems(ctx, "*", keys, chunk)
+		if err != nil {
+			for _, i := range chunk {
+				errs[i] = err
+			}
+			continue
+		}
+
+		for _, i := range chunk {
+			attributes, ok := items[keys[i]]
+			if !ok {
+				errs[i] = fmt.Errorf("Unable to find %s data from simpleDB: %w", keys[i], ErrNotFound)
+				continue
+			}
+
+			if err := validateObject(objects[i]); err != nil {
+				errs[i] = err
+				continue
+			}
+			errs[i] = db.setValue(objects[i], attributes)
+		}
+	}
+
+	return multiError(errs)
+}
+
+func (db *SimpleDB) DeleteMulti(keys []string) error {
+	return db.DeleteMultiContext(context.Background(), keys)
+}
+
+func (db *SimpleDB) DeleteMultiContext(ctx context.Context, keys []string) error {
+	errs := make([]error, len(keys))
+	db.validIndexes(keys, errs)
+	indexes := uniqueIndexes(keys, errs)
+
+	// Batch deletes ignore missing items, so select the existing ones first
+	found := []int{}
+	for _, chunk := range chunkIndexes(indexes, simpledbMaxInValues) {
+		items, err := db.selectItems(ctx, "itemName()", keys, chunk)
+		if err != nil {
+			for _, i := range chunk {
+				errs[i] = err
+			}
+			continue
+		}
+
+		for _, i := range chunk {
+			if _, ok := items[keys[i]]; !ok {
+				errs[i] = fmt.Errorf("Unable to find %s data from simpleDB: %w", keys[i], ErrNotFound)
+				continue
+			}
+			found = append(found, i)
+		}
+	}
+
+	for _, chunk := range chunkIndexes(found, simpledbBatchSize) {
+		items := []*simpledb.DeletableItem{}
+		for _, i := range chunk {
+			items = append(items, &simpledb.DeletableItem{
+				Name: aws.String(keys[i]),
+			})
+		}
+
+		batchDeleteAttributesInput := &simpledb.BatchDeleteAttributesInput{
+			DomainName: aws.String(db.domainName),
+			Items:      items,
+		}
+
+		if _, err := db.simpledbSvc.BatchDeleteAttributesWithContext(ctx, batchDeleteAttributesInput); err != nil {
+			for _, i := range chunk {
+				errs[i] = simpledbError("Unable to batch delete attributes from simpleDB", err)
+			}
+		}
+	}
+
+	return multiError(errs)
+}
+
+// validIndexes returns the indexes of the valid keys, and sets the error
+// of the invalid ones in errs.
+func (db *SimpleDB) validIndexes(keys []string, errs []error) []int {
+	indexes := []int{}
+	for i, key := range keys {
+		if err := validateKey(key, simpledbMaxKeyLen); err != nil {
+			errs[i] = err
+			continue
+		}
+		indexes = append(indexes, i)
+	}
+
+	return indexes
+}
+
+// selectItems selects the output of the items of the keys at the indexes,
+// and returns their attributes by item name.
+func (db *SimpleDB) selectItems(ctx context.Context, output string, keys []string, indexes []int) (map[string][]*simpledb.Attribute, error) {
+	names := []string{}
+	for _, i := range indexes {
+		names = append(names, quoteSelectValue(keys[i]))
+	}
+
+	selectExpression := fmt.Sprintf("select %s from %s where itemName() in (%s)",
+		output, quoteSelectName(db.domainName), strings.Join(names, ", "))
+	selectInput := &simpledb.SelectInput{
+		SelectExpression: aws.String(selectExpression),
+		ConsistentRead:   aws.Bool(true),
 	}
 
-	modelReflect := reflect.ValueOf(v).Elem()
-	modelRefType := modelReflect.Type()
-	fieldsCount := modelReflect.NumField()
+	items := map[string][]*simpledb.Attribute{}
+	for {
+		selectOutput, err := db.simpledbSvc.SelectWithContext(ctx, selectInput)
+		if err != nil {
+			return nil, simpledbError("Unable to select data from simpleDB", err)
+		}
 
-	for i := 0; i < fieldsCount; i++ {
-		field := modelReflect.Field(i)
-		fieldName := modelRefType.Field(i).Name
-		fieldValue := fmt.Sprintf("%v", field.Interface())
+		for _, item := range selectOutput.Items {
+			items[aws.StringValue(item.Name)] = item.Attributes
+		}
 
-		switch field.Kind() {
-		case reflect.Interface:
-			recursiveStructField(attrs, field.Interface())
-		default:
-			appendAttributes(attrs, fieldName, fieldValue)
+		if selectOutput.NextToken == nil {
+			return items, nil
 		}
+		selectInput.NextToken = selectOutput.NextToken
 	}
 }
 
-func restoreValue(fieldName string, attributes []*simpledb.Attribute) string {
+// quoteSelectValue quotes a string literal of a select expression, so keys
+// containing quotes can't change the expression.
+func quoteSelectValue(value string) string {
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+// quoteSelectName quotes a domain or attribute name of a select expression.
+func quoteSelectName(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// escapeLike escapes the wildcard and escape characters of a like value,
+// so they match literally.
+func escapeLike(value string) string {
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	return strings.Replace(value, "%", "\\%", -1)
+}
+
+// versionedAttributes returns the object attributes, or its blob attributes
+// in blob mode or for proto messages, including a new version.
+func (db *SimpleDB) versionedAttributes(object interface{}) ([]*simpledb.ReplaceableAttribute, error) {
+	attributes := []*simpledb.ReplaceableAttribute{}
+	if codec := messageCodec(db.Codec, object); codec != nil {
+		blobAttributes, err := encodeBlobAttributes(codec, db.Compression, object)
+		if err != nil {
+			return nil, err
+		}
+		attributes = blobAttributes
+	} else {
+		if err := recursiveStructField(&attributes, object); err != nil {
+			return nil, err
+		}
+		// Clears the blob of items stored in blob mode before
+		attributes = append(attributes, &simpledb.ReplaceableAttribute{
+			Name:    aws.String(simpledbBlobAttribute),
+			Value:   aws.String(""),
+			Replace: aws.Bool(true),
+		})
+	}
+
+	return append(attributes, &simpledb.ReplaceableAttribute{
+		Name:    aws.String(simpledbVersionAttribute),
+		Value:   aws.String(newVersion()),
+		Replace: aws.Bool(true),
+	}), nil
+}
+
+// setValue loads the attributes into the object, decoding the blob of items
+// stored in blob mode whatever the mode of the store.
+func (db *SimpleDB) setValue(object interface{}, attributes []*simpledb.Attribute) error {
 	for _, attribute := range attributes {
-		if fieldName == aws.StringValue(attribute.Name) {
-			return aws.StringValue(attribute.Value)
+		if aws.StringValue(attribute.Name) == simpledbBlobAttribute && aws.StringValue(attribute.Value) != "" {
+			return decodeBlobAttributes(object, attributes, db.Compression)
 		}
 	}
 
-	fieldValue := ""
-	fieldInfos := map[string]string{}
+	return recursiveSetValue(object, attributes)
+}
+
+// encodeBlobAttributes encodes the object with the codec and compression to
+// base64 parts that fit in attribute values. The blob attribute holds the
+// number of parts, so stale parts of a longer blob are not read.
+func encodeBlobAttributes(codec Codec, compression Compression, object interface{}) ([]*simpledb.ReplaceableAttribute, error) {
+	b, err := encodeObject(codec, compression, object)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(b)
+	attributes := []*simpledb.ReplaceableAttribute{}
+	for i := 0; i*simpledbMaxValueLen < len(encoded) || i == 0; i++ {
+		end := (i + 1) * simpledbMaxValueLen
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		attributes = append(attributes, &simpledb.ReplaceableAttribute{
+			Name:    aws.String(fmt.Sprintf("%s_%d", simpledbBlobAttribute, i+1)),
+			Value:   aws.String(encoded[i*simpledbMaxValueLen : end]),
+			Replace: aws.Bool(true),
+		})
+	}
+
+	return append(attributes, &simpledb.ReplaceableAttribute{
+		Name:    aws.String(simpledbBlobAttribute),
+		Value:   aws.String(fmt.Sprintf("%d %s", len(attributes), codec.ContentType())),
+		Replace: aws.Bool(true),
+	}), nil
+}
+
+func decodeBlobAttributes(object interface{}, attributes []*simpledb.Attribute, compression Compression) error {
+	values := map[string]string{}
+	for _, attribute := range attributes {
+		values[aws.StringValue(attribute.Name)] = aws.StringValue(attribute.Value)
+	}
+
+	count, contentType, _ := strings.Cut(values[simpledbBlobAttribute], " ")
+	parts, err := strconv.Atoi(count)
+	if err != nil {
+		return fmt.Errorf("Unable to parse blob attribute: %s", err.Error())
+	}
+
+	codec, err := codecByContentType(contentType)
+	if err != nil {
+		return err
+	}
+
+	encoded := ""
+	for i := 1; i <= parts; i++ {
+		part, ok := values[fmt.Sprintf("%s_%d", simpledbBlobAttribute, i)]
+		if !ok {
+			return fmt.Errorf("Unable to find blob part %d", i)
+		}
+		encoded += part
+	}
+
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("Unable to decode blob: %s", err.Error())
+	}
+
+	if err := decodeObject(codec, compression, b, object); err != nil {
+		return fmt.Errorf("Unable to unmarshal %s blob: %s", contentType, err.Error())
+	}
+
+	return nil
+}
+
+func recursiveSetValue(v interface{}, attributes []*simpledb.Attribute) error {
+	values := map[string]string{}
 	for _, attribute := range attributes {
-		attrName := aws.StringValue(attribute.Name)
-		attrValue := aws.StringValue(attribute.Value)
+		values[aws.StringValue(attribute.Name)] = aws.StringValue(attribute.Value)
+	}
 
-		if strings.Contains(attrName, fieldName+"_") {
-			attrNames := strings.Split(attrName, "_")
-			fieldInfos[attrNames[1]] = attrValue
+	err := unflattenFields(v, func(path string, t reflect.Type) (string, bool) {
+		return restoreValue(path, values)
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to set attributes to object: %w", err)
+	}
+
+	return nil
+}
+
+func recursiveStructField(attrs *[]*simpledb.ReplaceableAttribute, v interface{}) error {
+	return flattenFields(v, func(path string, field reflect.Value, noIndex bool) error {
+		// Attributes not written keep their value, so omitted fields are
+		// stored empty, which is loaded as the zero value
+		if !field.IsValid() {
+			appendAttributes(attrs, path, "")
+			return nil
 		}
+		appendAttributes(attrs, path, formatValue(field))
+		return nil
+	})
+}
+
+// restoreValue returns the value of the attribute, joining the parts of
+// values that appendAttributes split into numbered attributes.
+func restoreValue(fieldName string, values map[string]string) (string, bool) {
+	if value, ok := values[fieldName]; ok {
+		return value, true
 	}
 
-	cnt := len(fieldInfos)
-	for i := 1; i <= cnt; i++ {
-		fieldValue = fieldValue + fieldInfos[strconv.Itoa(i)]
+	fieldValue := ""
+	i := 1
+	for ; ; i++ {
+		part, ok := values[fmt.Sprintf("%s_%s", fieldName, strconv.Itoa(i))]
+		if !ok {
+			break
+		}
+		fieldValue = fieldValue + part
 	}
 
-	return fieldValue
+	return fieldValue, i > 1
 }
 
 func appendAttributes(attrs *[]*simpledb.ReplaceableAttribute, fieldName string, fieldValue string) {
@@ -0,0 +1,335 @@
+package blobstore
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/simpledb"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestSimpleDB returns a SimpleDB store sending its requests to handler.
+func newTestSimpleDB(t *testing.T, handler http.HandlerFunc) *SimpleDB {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:    aws.String(server.URL),
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	assert.Nil(t, err)
+
+	return &SimpleDB{
+		Name:        "testStore",
+		domainName:  "testStore",
+		simpledbSvc: simpledb.New(sess),
+	}
+}
+
+func TestSimpleDBContextErrors(t *testing.T) {
+	db := newTestSimpleDB(t, func(w http.ResponseWriter, r *http.Request) {
+		// Responds after the requests are cancelled
+		time.Sleep(200 * time.Millisecond)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := db.LoadContext(ctx, "redis", &TestDeployment{})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "Load should be DeadlineExceeded, got %v", err)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	err = db.StoreContext(ctx, "redis", &TestDeployment{Name: "redis"})
+	assert.True(t, errors.Is(err, context.Canceled), "Store should be Canceled, got %v", err)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err = db.ListKeysPageContext(ctx, "", "", 10)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "ListKeysPage should be DeadlineExceeded, got %v", err)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err = db.LoadPageContext(ctx, func() interface{} { return &TestDeployment{} }, "", 10)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "LoadPage should be DeadlineExceeded, got %v", err)
+}
+
+func TestSimpleDBSelectQuoting(t *testing.T) {
+	assert.Equal(t, "'redis'", quoteSelectValue("redis"))
+	assert.Equal(t, "'it''s'", quoteSelectValue("it's"))
+	assert.Equal(t, "''') or itemName() like ''%'", quoteSelectValue("') or itemName() like '%"))
+	assert.Equal(t, "'back`tick \"double\"'", quoteSelectValue("back`tick \"double\""))
+	assert.Equal(t, "'部署'", quoteSelectValue("部署"))
+
+	assert.Equal(t, "`deployments`", quoteSelectName("deployments"))
+	assert.Equal(t, "`back``tick`", quoteSelectName("back`tick"))
+
+	assert.Equal(t, "50\\%", escapeLike("50%"))
+	assert.Equal(t, "a\\\\b", escapeLike("a\\b"))
+}
+
+func TestSimpleDBTypedAttributes(t *testing.T) {
+	fields := newTypedFields()
+	replaceable := []*simpledb.ReplaceableAttribute{}
+	assert.Nil(t, recursiveStructField(&replaceable, fields))
+
+	attributes := []*simpledb.Attribute{}
+	for _, attribute := range replaceable {
+		attributes = append(attributes, &simpledb.Attribute{
+			Name:  attribute.Name,
+			Value: attribute.Value,
+		})
+	}
+
+	loaded := &typedFields{}
+	assert.Nil(t, recursiveSetValue(loaded, attributes))
+	fields.hidden = ""
+	assert.Equal(t, fields, loaded)
+}
+
+// simpledbAttributes puts the attributes of the object over the stored
+// attributes, and deletes the stale ones like SimpleDB puts.
+func simpledbAttributes(t *testing.T, object interface{}, attributes map[string]string) {
+	replaceable := []*simpledb.ReplaceableAttribute{}
+	assert.Nil(t, recursiveStructField(&replaceable, object))
+
+	stored := []*simpledb.Attribute{}
+	for name, value := range attributes {
+		stored = append(stored, &simpledb.Attribute{Name: aws.String(name), Value: aws.String(value)})
+	}
+	for _, attribute := range replaceable {
+		attributes[*attribute.Name] = *attribute.Value
+	}
+	for _, attribute := range staleAttributes(replaceable, stored) {
+		delete(attributes, *attribute.Name)
+	}
+}
+
+func loadSimpleDBAttributes(t *testing.T, object interface{}, attributes map[string]string) {
+	loaded := []*simpledb.Attribute{}
+	for name, value := range attributes {
+		loaded = append(loaded, &simpledb.Attribute{
+			Name:  aws.String(name),
+			Value: aws.String(value),
+		})
+	}
+	assert.Nil(t, recursiveSetValue(object, loaded))
+}
+
+func TestSimpleDBNestedAttributes(t *testing.T) {
+	attributes := map[string]string{}
+	fields := newNestedFields()
+	simpledbAttributes(t, fields, attributes)
+	loaded := loadNestedFields()
+	loadSimpleDBAttributes(t, loaded, attributes)
+	assert.Equal(t, fields, loaded)
+
+	// Puts replace the attributes of the new values only, the values of
+	// removed elements are left and must not be read
+	fields.Tags = fields.Tags[:1]
+	delete(fields.Spec.Labels, "app")
+	fields.SpecPtr = nil
+	simpledbAttributes(t, fields, attributes)
+	loaded = loadNestedFields()
+	loadSimpleDBAttributes(t, loaded, attributes)
+	assert.Equal(t, fields, loaded)
+
+	// Long values are split into numbered attributes, which replace the
+	// whole value
+	fields.Tags = []string{strings.Repeat("long", 1000)}
+	simpledbAttributes(t, fields, attributes)
+	assert.Contains(t, attributes, "Tags.0_4")
+	assert.NotContains(t, attributes, "Tags.0")
+	loaded = loadNestedFields()
+	loadSimpleDBAttributes(t, loaded, attributes)
+	assert.Equal(t, fields, loaded)
+
+	// Values split into fewer parts don't keep the previous last parts
+	fields.Tags = []string{strings.Repeat("long", 400)}
+	simpledbAttributes(t, fields, attributes)
+	assert.NotContains(t, attributes, "Tags.0_3")
+	loaded = loadNestedFields()
+	loadSimpleDBAttributes(t, loaded, attributes)
+	assert.Equal(t, fields, loaded)
+
+	// Whole values replace the parts
+	fields.Tags = []string{"short"}
+	simpledbAttributes(t, fields, attributes)
+	assert.NotContains(t, attributes, "Tags.0_1")
+	loaded = loadNestedFields()
+	loadSimpleDBAttributes(t, loaded, attributes)
+	assert.Equal(t, fields, loaded)
+}
+
+func TestSimpleDBLegacyNestedAttributes(t *testing.T) {
+	// Older versions stored the fields of interfaces under their own names
+	loaded := loadNestedFields()
+	loadSimpleDBAttributes(t, loaded, map[string]string{
+		"Name":     "redis",
+		"Replicas": "2",
+	})
+	assert.Equal(t, "redis", loaded.Name)
+	assert.Equal(t, &nestedSpec{Name: "redis", Replicas: 2}, loaded.Iface)
+}
+
+func TestSimpleDBTaggedAttributes(t *testing.T) {
+	attributes := map[string]string{}
+	fields := newTaggedFields()
+	fields.Omitted = "stored"
+	simpledbAttributes(t, fields, attributes)
+	assert.Equal(t, "stored", attributes["omitted"])
+	assert.Equal(t, "2", attributes["spec.replicas"])
+
+	// Omitted fields overwrite the stored value
+	fields.Omitted = ""
+	simpledbAttributes(t, fields, attributes)
+	loaded := &taggedFields{}
+	loadSimpleDBAttributes(t, loaded, attributes)
+	assert.Equal(t, fields, loaded)
+}
+
+// simpledbAttributesHandler responds to GetAttributes requests with the
+// attributes.
+func simpledbAttributesHandler(attributes map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<GetAttributesResponse><GetAttributesResult>")
+		for name, value := range attributes {
+			fmt.Fprint(w, "<Attribute><Name>")
+			xml.EscapeText(w, []byte(name))
+			fmt.Fprint(w, "</Name><Value>")
+			xml.EscapeText(w, []byte(value))
+			fmt.Fprint(w, "</Value></Attribute>")
+		}
+		fmt.Fprint(w, "</GetAttributesResult></GetAttributesResponse>")
+	}
+}
+
+func TestSimpleDBStatSize(t *testing.T) {
+	db := newTestSimpleDB(t, simpledbAttributesHandler(map[string]string{
+		"Name":                   "redis",
+		"Type":                   "GCP",
+		simpledbVersionAttribute: "3",
+		simpledbBlobAttribute:    "",
+	}))
+	info, err := db.Stat("redis")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(8), info.Size)
+	assert.Equal(t, "3", info.Version)
+	assert.Equal(t, 4, info.Attributes)
+
+	// Blob items count the size of the encoded object
+	deployment := &TestDeployment{Name: "redis", Type: strings.Repeat("GCP", 1000)}
+	replaceable, err := encodeBlobAttributes(JSONCodec{}, nil, deployment)
+	assert.Nil(t, err)
+	attributes := map[string]string{simpledbVersionAttribute: "4"}
+	for _, attribute := range replaceable {
+		attributes[*attribute.Name] = *attribute.Value
+	}
+	encoded, err := JSONCodec{}.Marshal(deployment)
+	assert.Nil(t, err)
+
+	db = newTestSimpleDB(t, simpledbAttributesHandler(attributes))
+	info, err = db.Stat("redis")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(encoded)), info.Size)
+}
+
+func TestSimpleDBLoadSingleRequest(t *testing.T) {
+	actions := []string{}
+	db := newTestSimpleDB(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		actions = append(actions, r.Form.Get("Action"))
+		fmt.Fprint(w, "<SelectResponse><SelectResult><Item><Name>redis</Name>")
+		fmt.Fprint(w, "<Attribute><Name>Name</Name><Value>redis</Value></Attribute>")
+		fmt.Fprint(w, "<Attribute><Name>Type</Name><Value>GCP</Value></Attribute>")
+		fmt.Fprint(w, "</Item></SelectResult></SelectResponse>")
+	})
+
+	// The selected attributes are loaded without getting them again
+	loaded := &TestDeployment{}
+	assert.Nil(t, db.Load("redis", loaded))
+	assert.Equal(t, &TestDeployment{Name: "redis", Type: "GCP"}, loaded)
+	assert.Equal(t, []string{"Select"}, actions)
+}
+
+func TestSimpleDBLegacyVersion(t *testing.T) {
+	// Items stored before versions were kept have no version attribute
+	puts := []string{}
+	db := newTestSimpleDB(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("Action") == "PutAttributes" {
+			puts = append(puts, r.Form.Get("Expected.Name")+"="+r.Form.Get("Expected.Exists"))
+			fmt.Fprint(w, "<PutAttributesResponse></PutAttributesResponse>")
+			return
+		}
+		simpledbAttributesHandler(map[string]string{"Name": "redis"})(w, r)
+	})
+
+	info, err := db.Stat("redis")
+	assert.Nil(t, err)
+	assert.Equal(t, "0", info.Version)
+
+	err = db.Create("redis", &TestDeployment{Name: "redis"})
+	assert.True(t, errors.Is(err, ErrConflict), "Create of a legacy item should be ErrConflict, got %v", err)
+
+	err = db.StoreIfVersion("redis", &TestDeployment{Name: "redis"}, "1")
+	assert.True(t, errors.Is(err, ErrConflict), "StoreIfVersion of another version should be ErrConflict, got %v", err)
+
+	err = db.StoreIfVersion("redis", &TestDeployment{Name: "redis"}, "0")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"@version=false"}, puts)
+}
+
+func TestSimpleDBStaleAttributes(t *testing.T) {
+	deployment := &TestDeployment{Name: "redis", Type: strings.Repeat("GCP", 1000)}
+	blob, err := encodeBlobAttributes(JSONCodec{}, nil, deployment)
+	assert.Nil(t, err)
+	flattened := []*simpledb.ReplaceableAttribute{}
+	assert.Nil(t, recursiveStructField(&flattened, &TestDeployment{Name: "redis", Type: "GCP"}))
+	flattened = append(flattened, &simpledb.ReplaceableAttribute{
+		Name:  aws.String(simpledbBlobAttribute),
+		Value: aws.String(""),
+	})
+
+	stored := func(written []*simpledb.ReplaceableAttribute) []*simpledb.Attribute {
+		attributes := []*simpledb.Attribute{{Name: aws.String(simpledbVersionAttribute), Value: aws.String("1")}}
+		for _, attribute := range written {
+			attributes = append(attributes, &simpledb.Attribute{Name: attribute.Name, Value: attribute.Value})
+		}
+		return attributes
+	}
+	names := func(attributes []*simpledb.DeletableAttribute) []string {
+		names := []string{}
+		for _, attribute := range attributes {
+			names = append(names, aws.StringValue(attribute.Name))
+		}
+		return names
+	}
+
+	// Going back to attributes deletes the blob parts
+	parts := []string{}
+	for i := 1; i < len(blob); i++ {
+		parts = append(parts, fmt.Sprintf("%s_%d", simpledbBlobAttribute, i))
+	}
+	assert.True(t, len(parts) > 1, "Blob should be split into parts")
+	assert.ElementsMatch(t, parts, names(staleAttributes(flattened, stored(blob))))
+	// Going to a blob deletes the attributes of the fields
+	assert.ElementsMatch(t, []string{"Name", "Type"}, names(staleAttributes(blob, stored(flattened))))
+	// Writing the same mode deletes nothing
+	assert.Empty(t, staleAttributes(blob, stored(blob)))
+	assert.Empty(t, staleAttributes(flattened, stored(flattened)))
+}
@@ -0,0 +1,289 @@
+package blobstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	jsonMarshalerType   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	// Cache of whether types have blobstore tags
+	blobstoreTagTypes sync.Map
+)
+
+// marshalJSON encodes the object like encoding/json does, except fields are
+// named by their blobstore tag first, so JSON stores use the same names as
+// the attribute stores. Types without blobstore tags are encoded by
+// encoding/json.
+func marshalJSON(object interface{}) ([]byte, error) {
+	return encodeJSON(reflect.ValueOf(object))
+}
+
+// unmarshalJSON decodes data encoded by marshalJSON into the object.
+func unmarshalJSON(data []byte, object interface{}) error {
+	v := reflect.ValueOf(object)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return json.Unmarshal(data, object)
+	}
+
+	return decodeJSON(data, v.Elem())
+}
+
+// hasBlobstoreTags returns whether the type, or the types it holds, have
+// fields with blobstore tags.
+func hasBlobstoreTags(t reflect.Type) bool {
+	if cached, ok := blobstoreTagTypes.Load(t); ok {
+		return cached.(bool)
+	}
+
+	result := typeHasBlobstoreTags(t, map[reflect.Type]bool{})
+	blobstoreTagTypes.Store(t, result)
+	return result
+}
+
+func typeHasBlobstoreTags(t reflect.Type, visited map[reflect.Type]bool) bool {
+	if visited[t] {
+		return false
+	}
+	visited[t] = true
+
+	// Types encoding themselves don't use the tags of their fields
+	if t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType) ||
+		t.Implements(jsonUnmarshalerType) || reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return false
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return typeHasBlobstoreTags(t.Elem(), visited)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if _, ok := t.Field(i).Tag.Lookup("blobstore"); ok {
+				return true
+			}
+			if typeHasBlobstoreTags(t.Field(i).Type, visited) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func encodeJSON(v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return []byte("null"), nil
+	}
+
+	if v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return []byte("null"), nil
+		}
+		return encodeJSON(v.Elem())
+	}
+
+	if !hasBlobstoreTags(v.Type()) {
+		return json.Marshal(v.Interface())
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return []byte("null"), nil
+		}
+		return encodeJSON(v.Elem())
+	case reflect.Struct:
+		var buf bytes.Buffer
+		buf.WriteByte('{')
+		err := visitFields(v, false, func(field reflect.Value, tag fieldTag) error {
+			if tag.omitEmpty && isEmptyValue(field) {
+				return nil
+			}
+
+			value, err := encodeJSON(field)
+			if err != nil {
+				return err
+			}
+			name, err := json.Marshal(tag.name)
+			if err != nil {
+				return err
+			}
+
+			if buf.Len() > 1 {
+				buf.WriteByte(',')
+			}
+			buf.Write(name)
+			buf.WriteByte(':')
+			buf.Write(value)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteByte('}')
+		return buf.Bytes(), nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return []byte("null"), nil
+		}
+		items := make([]json.RawMessage, v.Len())
+		for i := range items {
+			item, err := encodeJSON(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return json.Marshal(items)
+	case reflect.Map:
+		if v.IsNil() {
+			return []byte("null"), nil
+		}
+		values := map[string]json.RawMessage{}
+		for _, key := range v.MapKeys() {
+			name, err := jsonMapKey(key)
+			if err != nil {
+				return nil, err
+			}
+			value, err := encodeJSON(v.MapIndex(key))
+			if err != nil {
+				return nil, err
+			}
+			values[name] = value
+		}
+		return json.Marshal(values)
+	}
+
+	return json.Marshal(v.Interface())
+}
+
+func jsonMapKey(key reflect.Value) (string, error) {
+	switch key.Kind() {
+	case reflect.String:
+		return key.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(key.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(key.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("Unable to encode map key of type %s", key.Type())
+}
+
+// decodeJSON decodes the data into v, which must be settable.
+func decodeJSON(data []byte, v reflect.Value) error {
+	if v.Kind() == reflect.Interface {
+		// Loads into pointers set before loading, like encoding/json
+		if !v.IsNil() && v.Elem().Kind() == reflect.Ptr && !v.Elem().IsNil() && string(bytes.TrimSpace(data)) != "null" {
+			return decodeJSON(data, v.Elem().Elem())
+		}
+		return json.Unmarshal(data, v.Addr().Interface())
+	}
+
+	if !hasBlobstoreTags(v.Type()) {
+		return json.Unmarshal(data, v.Addr().Interface())
+	}
+
+	if string(bytes.TrimSpace(data)) == "null" {
+		switch v.Kind() {
+		case reflect.Ptr, reflect.Map, reflect.Slice:
+			v.Set(reflect.Zero(v.Type()))
+		}
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return decodeJSON(data, v.Elem())
+	case reflect.Struct:
+		values := map[string]json.RawMessage{}
+		if err := json.Unmarshal(data, &values); err != nil {
+			return err
+		}
+		return visitFields(v, true, func(field reflect.Value, tag fieldTag) error {
+			value, ok := values[tag.name]
+			if !ok {
+				// Names are matched case insensitively, like encoding/json
+				for name, nameValue := range values {
+					if strings.EqualFold(name, tag.name) {
+						value, ok = nameValue, true
+						break
+					}
+				}
+			}
+			if !ok {
+				return nil
+			}
+			return decodeJSON(value, field)
+		})
+	case reflect.Slice, reflect.Array:
+		items := []json.RawMessage{}
+		if err := json.Unmarshal(data, &items); err != nil {
+			return err
+		}
+		if v.Kind() == reflect.Slice {
+			v.Set(reflect.MakeSlice(v.Type(), len(items), len(items)))
+		}
+		for i := 0; i < v.Len(); i++ {
+			if i >= len(items) {
+				v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+				continue
+			}
+			if err := decodeJSON(items[i], v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		values := map[string]json.RawMessage{}
+		if err := json.Unmarshal(data, &values); err != nil {
+			return err
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), len(values)))
+		}
+		for name, value := range values {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := parseMapKey(name, key); err != nil {
+				return err
+			}
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := decodeJSON(value, elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+		return nil
+	}
+
+	return json.Unmarshal(data, v.Addr().Interface())
+}
+
+func parseMapKey(name string, key reflect.Value) error {
+	switch key.Kind() {
+	case reflect.String:
+		key.SetString(name)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(name, 10, key.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("Unable to decode map key %s: %s", name, err.Error())
+		}
+		key.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, err := strconv.ParseUint(name, 10, key.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("Unable to decode map key %s: %s", name, err.Error())
+		}
+		key.SetUint(u)
+	default:
+		return fmt.Errorf("Unable to decode map key of type %s", key.Type())
+	}
+	return nil
+}
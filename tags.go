@@ -0,0 +1,117 @@
+package blobstore
+
+import (
+	"reflect"
+	"strings"
+)
+
+// fieldTag holds the options of a struct field tag.
+type fieldTag struct {
+	// Name of the field in stores
+	name string
+	// Name of the Go field
+	fieldName string
+	// Whether the field is not stored when it's empty
+	omitEmpty bool
+	// Whether the field is not indexed by stores that index values
+	noIndex bool
+}
+
+// parseFieldTag returns the options of the field's blobstore tag, or of its
+// json tag if it has none, and false if the field is excluded with "-".
+func parseFieldTag(field reflect.StructField) (fieldTag, bool) {
+	tag, ok := field.Tag.Lookup("blobstore")
+	if !ok {
+		tag = field.Tag.Get("json")
+	}
+	if tag == "-" {
+		return fieldTag{}, false
+	}
+
+	options := strings.Split(tag, ",")
+	fieldTag := fieldTag{name: options[0]}
+	for _, option := range options[1:] {
+		switch option {
+		case "omitempty":
+			fieldTag.omitEmpty = true
+		case "noindex":
+			fieldTag.noIndex = true
+		}
+	}
+
+	return fieldTag, true
+}
+
+// visitFields calls fn with every stored field of the struct v and its tag
+// options. Like encoding/json, the fields of embedded structs without a
+// tag name are visited as fields of v. Nil embedded struct pointers are
+// skipped, unless alloc is set to set them to new structs.
+func visitFields(v reflect.Value, alloc bool, fn func(field reflect.Value, tag fieldTag) error) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		structField := t.Field(i)
+		tag, ok := parseFieldTag(structField)
+		if !ok {
+			continue
+		}
+
+		field := v.Field(i)
+		if structField.Anonymous && tag.name == "" {
+			fieldType := structField.Type
+			if fieldType.Kind() == reflect.Ptr {
+				fieldType = fieldType.Elem()
+			}
+			if fieldType.Kind() == reflect.Struct && fieldType != timeType {
+				if field.Kind() == reflect.Ptr {
+					if field.IsNil() {
+						if !alloc || !field.CanSet() {
+							continue
+						}
+						field.Set(reflect.New(fieldType))
+					}
+					field = field.Elem()
+				}
+				if err := visitFields(field, alloc, fn); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		if structField.PkgPath != "" {
+			continue
+		}
+
+		tag.fieldName = structField.Name
+		if tag.name == "" {
+			tag.name = structField.Name
+		}
+		if err := fn(field, tag); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isEmptyValue returns whether the value is empty, as defined by the
+// omitempty option of encoding/json.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Complex64, reflect.Complex128:
+		return v.Complex() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
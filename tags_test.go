@@ -0,0 +1,168 @@
+package blobstore
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	datastore "google.golang.org/api/datastore/v1"
+)
+
+type taggedSpec struct {
+	Replicas int    `blobstore:"replicas"`
+	Image    string `json:"image,omitempty"`
+}
+
+type TaggedBase struct {
+	Region string `blobstore:"region"`
+}
+
+type taggedFields struct {
+	TaggedBase
+	Name     string            `blobstore:"name"`
+	Renamed  string            `blobstore:"renamed" json:"jsonName"`
+	JSONName string            `json:"json_name"`
+	Skipped  string            `blobstore:"-"`
+	Omitted  string            `blobstore:"omitted,omitempty"`
+	Kept     int               `blobstore:",omitempty"`
+	Notes    string            `blobstore:"notes,noindex"`
+	Spec     *taggedSpec       `blobstore:"spec"`
+	Specs    []taggedSpec      `blobstore:"specs"`
+	ByName   map[string]string `blobstore:"byName,omitempty"`
+	Created  time.Time         `blobstore:"created"`
+}
+
+func newTaggedFields() *taggedFields {
+	return &taggedFields{
+		TaggedBase: TaggedBase{Region: "us-east-1"},
+		Name:       "redis",
+		Renamed:    "renamed",
+		JSONName:   "json",
+		Kept:       1,
+		Notes:      strings.Repeat("note", 500),
+		Spec:       &taggedSpec{Replicas: 2, Image: "redis:4"},
+		Specs:      []taggedSpec{{Replicas: 1}},
+		Created:    time.Date(2017, 10, 3, 12, 30, 15, 0, time.UTC),
+	}
+}
+
+func TestFlattenTaggedFields(t *testing.T) {
+	values := map[string]reflect.Value{}
+	noIndexes := map[string]bool{}
+	err := flattenFields(newTaggedFields(), func(path string, value reflect.Value, noIndex bool) error {
+		values[path] = value
+		noIndexes[path] = noIndex
+		return nil
+	})
+	assert.Nil(t, err)
+
+	names := []string{}
+	for name := range values {
+		names = append(names, name)
+	}
+	assert.ElementsMatch(t, []string{
+		"region", "name", "renamed", "json_name", "omitted", "Kept", "notes",
+		"spec", "spec.replicas", "spec.image", "specs", "specs.0.replicas",
+		"specs.0.image", "byName", "created",
+	}, names)
+
+	assert.False(t, values["omitted"].IsValid(), "Empty omitempty field should be omitted")
+	assert.False(t, values["specs.0.image"].IsValid(), "Empty omitempty field should be omitted")
+	assert.True(t, values["Kept"].IsValid(), "Non empty omitempty field should be kept")
+	assert.True(t, noIndexes["notes"])
+	assert.False(t, noIndexes["name"])
+}
+
+func TestLoadLegacyFieldNames(t *testing.T) {
+	// Items stored before tags were read have the Go field names
+	loaded := &taggedFields{}
+	loadSimpleDBAttributes(t, loaded, map[string]string{
+		"Region":              "us-east-1",
+		"Name":                "redis",
+		"JSONName":            "json",
+		"Spec":                structMarker,
+		"Spec.Replicas":       "2",
+		"Spec.Image":          "redis:4",
+		"Specs":               "1",
+		"Specs.0.Replicas":    "1",
+		"Created":             "2017-10-03T12:30:15Z",
+		simpledbBlobAttribute: "",
+	})
+	assert.Equal(t, "us-east-1", loaded.Region)
+	assert.Equal(t, "redis", loaded.Name)
+	assert.Equal(t, "json", loaded.JSONName)
+	assert.Equal(t, &taggedSpec{Replicas: 2, Image: "redis:4"}, loaded.Spec)
+	assert.Equal(t, []taggedSpec{{Replicas: 1}}, loaded.Specs)
+	assert.Equal(t, 2017, loaded.Created.Year())
+
+	// Values under the tag names are read first
+	props := map[string]datastore.Value{
+		"Name": {StringValue: "legacy"},
+		"name": {StringValue: "redis"},
+	}
+	loaded = &taggedFields{}
+	assert.Nil(t, recursiveSetEntityValue(loaded, props))
+	assert.Equal(t, "redis", loaded.Name)
+}
+
+func TestDatastoreTaggedProperties(t *testing.T) {
+	fields := newTaggedFields()
+	fields.Skipped = "skipped"
+	props := map[string]datastore.Value{}
+	assert.Nil(t, recursiveEntityProperties(props, fields))
+	assert.NotContains(t, props, "omitted")
+	assert.NotContains(t, props, "Skipped")
+	// Strings that are not indexed are not split
+	assert.True(t, props["notes"].ExcludeFromIndexes)
+	assert.Equal(t, fields.Notes, props["notes"].StringValue)
+
+	loaded := &taggedFields{}
+	assert.Nil(t, recursiveSetEntityValue(loaded, props))
+	fields.Skipped = ""
+	assert.Equal(t, fields, loaded)
+}
+
+func TestTaggedJSON(t *testing.T) {
+	fields := newTaggedFields()
+	fields.Skipped = "skipped"
+	b, err := marshalJSON(fields)
+	assert.Nil(t, err)
+
+	values := map[string]json.RawMessage{}
+	assert.Nil(t, json.Unmarshal(b, &values))
+	assert.Contains(t, values, "renamed")
+	assert.Contains(t, values, "json_name")
+	assert.Contains(t, values, "region")
+	assert.NotContains(t, values, "Skipped")
+	assert.NotContains(t, values, "omitted")
+	assert.Equal(t, `{"replicas":2,"image":"redis:4"}`, string(values["spec"]))
+
+	loaded := &taggedFields{}
+	assert.Nil(t, unmarshalJSON(b, loaded))
+	fields.Skipped = ""
+	assert.Equal(t, fields, loaded)
+
+	// Types without blobstore tags are encoded like encoding/json does
+	spec := &nestedSpec{Name: "redis", Labels: map[string]string{"app": "redis"}}
+	b, err = marshalJSON(spec)
+	assert.Nil(t, err)
+	expected, _ := json.Marshal(spec)
+	assert.Equal(t, string(expected), string(b))
+}
+
+func TestFileStoreTaggedFields(t *testing.T) {
+	store, err := NewFileStore("testStore")
+	if err != nil {
+		panic(err)
+	}
+
+	fields := newTaggedFields()
+	assert.Nil(t, store.Store("tagged", fields), "Store error should be nil")
+
+	loaded := &taggedFields{}
+	assert.Nil(t, store.Load("tagged", loaded), "Load error should be nil")
+	assert.Equal(t, fields, loaded)
+}
@@ -0,0 +1,59 @@
+package blobstore
+
+import (
+	"fmt"
+)
+
+// TypedStore wraps a BlobStore so that objects are stored and loaded as *T,
+// saving callers from type asserting the result of LoadAll.
+type TypedStore[T any] struct {
+	BlobStore BlobStore
+}
+
+func NewTypedStore[T any](store BlobStore) *TypedStore[T] {
+	return &TypedStore[T]{
+		BlobStore: store,
+	}
+}
+
+func (store *TypedStore[T]) Store(key string, object *T) error {
+	return store.BlobStore.Store(key, object)
+}
+
+func (store *TypedStore[T]) Load(key string) (*T, error) {
+	object := new(T)
+	if err := store.BlobStore.Load(key, object); err != nil {
+		return nil, err
+	}
+
+	return object, nil
+}
+
+func (store *TypedStore[T]) LoadAll() ([]*T, error) {
+	results, err := store.BlobStore.LoadAll(func() interface{} {
+		return new(T)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	values, ok := results.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Unexpected LoadAll result type %T", results)
+	}
+
+	items := make([]*T, 0, len(values))
+	for _, value := range values {
+		item, ok := value.(*T)
+		if !ok {
+			return nil, fmt.Errorf("Unexpected LoadAll item type %T", value)
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+func (store *TypedStore[T]) Delete(key string) error {
+	return store.BlobStore.Delete(key)
+}
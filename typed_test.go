@@ -0,0 +1,30 @@
+package blobstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTypedStore(t *testing.T) {
+	fileStore, err := NewFileStore("testStore")
+	if err != nil {
+		panic(err)
+	}
+	store := NewTypedStore[TestDeployment](fileStore)
+
+	err = store.Store("redis", &TestDeployment{Name: "redis", Type: "GCP"})
+	assert.Nil(t, err, "Store error should be nil")
+
+	deployment, err := store.Load("redis")
+	assert.Nil(t, err, "Load error should be nil")
+	assert.Equal(t, "GCP", deployment.Type)
+
+	deployments, err := store.LoadAll()
+	assert.Nil(t, err, "LoadAll error should be nil")
+	assert.Equal(t, 1, len(deployments))
+	assert.Equal(t, "redis", deployments[0].Name)
+
+	err = store.Delete("redis")
+	assert.Nil(t, err, "Delete error should be nil")
+}
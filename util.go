@@ -1,5 +1,109 @@
 package blobstore
 
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Number of objects loaded at a time by Iterate
+const iteratePageSize = 100
+
+// pageLoadFunc loads up to limit objects after the cursor and returns their
+// keys, objects and the cursor of the next page.
+type pageLoadFunc func(ctx context.Context, f func() interface{}, cursor string, limit int) ([]string, []interface{}, string, error)
+
 func getDomainName(name string, config BlobStoreConfig) string {
 	return name + config.GetString("store.domainPostfix")
 }
+
+// getConfigBool parses a boolean setting, which is false when it's not set
+// or not a boolean.
+func getConfigBool(config BlobStoreConfig, name string) bool {
+	value, err := strconv.ParseBool(config.GetString(name))
+	return err == nil && value
+}
+
+// getConfigInt parses an integer setting, which is 0 when it's not set.
+func getConfigInt(config BlobStoreConfig, name string) (int, error) {
+	value := config.GetString(name)
+	if value == "" {
+		return 0, nil
+	}
+
+	return strconv.Atoi(value)
+}
+
+// pageKeys sorts the keys and returns up to limit keys with the prefix that
+// come after the cursor, which is the last key of the previous page.
+// A limit less than 1 returns all the remaining keys.
+func pageKeys(keys []string, prefix string, cursor string, limit int) ([]string, string) {
+	sort.Strings(keys)
+
+	page := []string{}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) || (cursor != "" && key <= cursor) {
+			continue
+		}
+
+		if limit > 0 && len(page) == limit {
+			return page, page[len(page)-1]
+		}
+		page = append(page, key)
+	}
+
+	return page, ""
+}
+
+// iteratePages calls fn for every object returned by loadPage, loading
+// iteratePageSize objects at a time.
+func iteratePages(ctx context.Context, loadPage pageLoadFunc, f func() interface{}, fn func(key string, object interface{}) error) error {
+	cursor := ""
+	for {
+		keys, items, next, err := loadPage(ctx, f, cursor, iteratePageSize)
+		if err != nil {
+			return err
+		}
+
+		for i, key := range keys {
+			if err := fn(key, items[i]); err != nil {
+				if errors.Is(err, ErrStopIteration) {
+					return nil
+				}
+				return err
+			}
+		}
+
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// chunkIndexes splits the indexes into chunks of at most size indexes.
+func chunkIndexes(indexes []int, size int) [][]int {
+	chunks := [][]int{}
+	for len(indexes) > size {
+		chunks = append(chunks, indexes[:size])
+		indexes = indexes[size:]
+	}
+	if len(indexes) > 0 {
+		chunks = append(chunks, indexes)
+	}
+
+	return chunks
+}
+
+// newVersion returns a random version for stores that can't increment versions.
+func newVersion() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic("Unable to read random bytes: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}